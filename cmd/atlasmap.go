@@ -1,14 +1,21 @@
 package main
 
 import (
+	"context"
 	"log"
+	"os"
+	"os/signal"
+	"syscall"
 
 	"github.com/antihax/AtlasMap/pkg/atlasmapserver"
 )
 
 func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
 	s := atlasmapserver.NewAtlasMapServer()
-	if err := s.Run(); err != nil {
+	if err := s.Run(ctx); err != nil {
 		log.Fatalln(err)
 	}
 	log.Println("Server quit!")
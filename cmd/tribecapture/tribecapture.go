@@ -0,0 +1,136 @@
+// tribecapture records raw tribemsg:* payloads from the Atlas redis server and
+// replays them through the tribe message decoders offline.
+//
+//	tribecapture capture -out capture.jsonl
+//	tribecapture replay -in capture.jsonl [-crc 834710557]
+package main
+
+import (
+	"bufio"
+	"context"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"os/signal"
+	"syscall"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver"
+	"github.com/rs/zerolog/log"
+)
+
+func main() {
+	if len(os.Args) < 2 {
+		usage()
+	}
+
+	var err error
+	switch os.Args[1] {
+	case "capture":
+		err = capture(os.Args[2:])
+	case "replay":
+		err = replay(os.Args[2:])
+	default:
+		usage()
+	}
+
+	if err != nil {
+		log.Fatal().Err(err).Msg(os.Args[1])
+	}
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, "usage: %s capture|replay [flags]\n", os.Args[0])
+	os.Exit(2)
+}
+
+// capture records every tribe message to the output file as JSON lines until
+// interrupted. The Atlas redis is configured with the same ATLAS_REDIS_* and
+// ATLAS_TRIBE_REDIS_* variables as the server.
+func capture(args []string) error {
+	flags := flag.NewFlagSet("capture", flag.ExitOnError)
+	out := flags.String("out", "capture.jsonl", "file to append captured messages to")
+	flags.Parse(args)
+
+	opts, err := atlasmapserver.AtlasDBOptions()
+	if err != nil {
+		return err
+	}
+	db, err := atlasdb.NewAtlasDBWithOptions(opts)
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+
+	f, err := os.OpenFile(*out, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	log.Info().Msgf("capturing tribemsg:* to %s", *out)
+	enc := json.NewEncoder(f)
+	count := 0
+	for msg := range db.SubRawTribeMessages(ctx) {
+		if err := enc.Encode(msg); err != nil {
+			return err
+		}
+		count++
+	}
+	log.Info().Msgf("captured %d messages", count)
+	return nil
+}
+
+// replay decodes every captured message as the server does and writes the
+// resulting events to stdout. Unknown messages are hex dumped.
+func replay(args []string) error {
+	flags := flag.NewFlagSet("replay", flag.ExitOnError)
+	in := flags.String("in", "capture.jsonl", "captured messages file")
+	crc := flags.Int64("crc", 0, "only replay messages with this CRC")
+	flags.Parse(args)
+
+	f, err := os.Open(*in)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	registry := atlasdb.NewMessageRegistry()
+	enc := json.NewEncoder(os.Stdout)
+	dec := json.NewDecoder(bufio.NewReader(f))
+	for {
+		msg := atlasdb.RawTribeMessage{}
+		if err := dec.Decode(&msg); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		e, header, err := registry.DecodeTribeMessage(msg)
+		if header == nil {
+			log.Error().Err(err).Msgf("%s %s", msg.Time, msg.Channel)
+			continue
+		}
+		if *crc != 0 && int64(header.CRC) != *crc {
+			continue
+		}
+
+		switch {
+		case errors.Is(err, atlasdb.ErrUnknownMessage):
+			fmt.Printf("%s %s: %s\n%s\n", msg.Time, msg.Channel, err, hex.Dump(msg.Payload))
+		case err != nil:
+			log.Error().Err(err).Msgf("%s %s crc %d", msg.Time, msg.Channel, header.CRC)
+		case e != nil:
+			if err := enc.Encode(e); err != nil {
+				return err
+			}
+		}
+	}
+}
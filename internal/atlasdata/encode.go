@@ -0,0 +1,214 @@
+package atlasdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"reflect"
+	"unicode/utf16"
+
+	"github.com/lunixbochs/struc"
+)
+
+// Encoder is implemented by messages which encode themselves rather than
+// relying on a fixed struc layout.
+type Encoder interface {
+	Encode(w io.Writer) error
+}
+
+// Pack encodes v to w using the Encoder of v when available, falling back to
+// the struc layout.
+func Pack(w io.Writer, v interface{}) error {
+	if e, ok := v.(Encoder); ok {
+		return e.Encode(w)
+	}
+	return struc.Pack(w, v)
+}
+
+// PackMessage frames the message with the BubbleWrap header as published to
+// the tribemsg redis channels.
+func PackMessage(header BubbleWrap, msg interface{}) ([]byte, error) {
+	buf := &bytes.Buffer{}
+	if err := struc.Pack(buf, &header); err != nil {
+		return nil, err
+	}
+	if err := Pack(buf, msg); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NewFString creates a null terminated FString for packing.
+func NewFString(s string) FString {
+	return FString{String: s + "\u0000"}
+}
+
+// WriteFString writes a null terminated, length prefixed UE string. Strings
+// outside of ASCII are written as UTF-16.
+func WriteFString(w io.Writer, s string) error {
+	ascii := true
+	for i := 0; i < len(s); i++ {
+		if s[i] >= 0x80 {
+			ascii = false
+			break
+		}
+	}
+
+	if ascii {
+		if err := binary.Write(w, binary.LittleEndian, int32(len(s)+1)); err != nil {
+			return err
+		}
+		_, err := io.WriteString(w, s+"\u0000")
+		return err
+	}
+
+	u := utf16.Encode([]rune(s + "\u0000"))
+	if err := binary.Write(w, binary.LittleEndian, -int32(len(u))); err != nil {
+		return err
+	}
+	return binary.Write(w, binary.LittleEndian, u)
+}
+
+// MarshalProperties writes the exported fields of the struct pointed to by v
+// as UE properties. The property type is taken from the `ue` tag or inferred
+// from the field type. Slice and array fields are written as one property per
+// element.
+func MarshalProperties(w io.Writer, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("MarshalProperties requires a pointer to a struct")
+	}
+	rv = rv.Elem()
+
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		opts, ok := fieldOptions(t.Field(i))
+		if !ok {
+			continue
+		}
+
+		field := rv.Field(i)
+		switch {
+		case field.Kind() == reflect.Array,
+			field.Kind() == reflect.Slice && field.Type().Elem().Kind() != reflect.Uint8:
+			for j := 0; j < field.Len(); j++ {
+				if err := writeProperty(w, opts, int32(j), field.Index(j)); err != nil {
+					return err
+				}
+			}
+		default:
+			if err := writeProperty(w, opts, 0, field); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// writeProperty writes the property tag and value of a single field.
+func writeProperty(w io.Writer, opts propertyOptions, index int32, v reflect.Value) error {
+	if opts.Type == "" {
+		var err error
+		if opts.Type, opts.Sub, err = inferPropertyType(v); err != nil {
+			return fmt.Errorf("property %s: %w", opts.Name, err)
+		}
+	}
+
+	// Bool values are stored in the header and have no size
+	if opts.Type == "BoolProperty" {
+		if err := writePropertyTag(w, opts, 0, index); err != nil {
+			return err
+		}
+		return binary.Write(w, binary.LittleEndian, v.Bool())
+	}
+
+	value := &bytes.Buffer{}
+	switch {
+	case opts.Type == "StrProperty", opts.Type == "NameProperty", opts.Type == "EnumProperty",
+		opts.Type == "ByteProperty" && opts.Sub != "" && opts.Sub != "None":
+		if v.Kind() != reflect.String {
+			return fmt.Errorf("property %s: %s requires a string", opts.Name, opts.Type)
+		}
+		if err := WriteFString(value, v.String()); err != nil {
+			return err
+		}
+	case opts.Type == "ByteProperty":
+		if opts.Sub == "" {
+			opts.Sub = "None"
+		}
+		if err := binary.Write(value, binary.LittleEndian, uint8(v.Uint())); err != nil {
+			return err
+		}
+	case v.Kind() == reflect.Slice:
+		value.Write(v.Bytes())
+	default:
+		if err := binary.Write(value, binary.LittleEndian, v.Interface()); err != nil {
+			return fmt.Errorf("property %s: %w", opts.Name, err)
+		}
+	}
+
+	if err := writePropertyTag(w, opts, int32(value.Len()), index); err != nil {
+		return err
+	}
+	_, err := value.WriteTo(w)
+	return err
+}
+
+// writePropertyTag writes the property header up to the value.
+func writePropertyTag(w io.Writer, opts propertyOptions, size int32, index int32) error {
+	if err := WriteFString(w, opts.Name); err != nil {
+		return err
+	}
+	if err := WriteFString(w, opts.Type); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, size); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, index); err != nil {
+		return err
+	}
+
+	switch opts.Type {
+	case "StructProperty", "ByteProperty", "EnumProperty":
+		return WriteFString(w, opts.Sub)
+	}
+	return nil
+}
+
+// inferPropertyType maps a Go type to the UE property type.
+func inferPropertyType(v reflect.Value) (string, string, error) {
+	if v.Type() == reflect.TypeOf(FVector2D{}) {
+		return "StructProperty", "Vector2D", nil
+	}
+
+	switch v.Kind() {
+	case reflect.Bool:
+		return "BoolProperty", "", nil
+	case reflect.Int8:
+		return "Int8Property", "", nil
+	case reflect.Int16:
+		return "Int16Property", "", nil
+	case reflect.Int32:
+		return "IntProperty", "", nil
+	case reflect.Int64:
+		return "Int64Property", "", nil
+	case reflect.Uint8:
+		return "ByteProperty", "None", nil
+	case reflect.Uint16:
+		return "UInt16Property", "", nil
+	case reflect.Uint32:
+		return "UInt32Property", "", nil
+	case reflect.Uint64:
+		return "UInt64Property", "", nil
+	case reflect.Float32:
+		return "FloatProperty", "", nil
+	case reflect.Float64:
+		return "DoubleProperty", "", nil
+	case reflect.String:
+		return "StrProperty", "", nil
+	}
+	return "", "", fmt.Errorf("cannot infer property type of %s", v.Type())
+}
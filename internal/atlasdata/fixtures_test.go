@@ -0,0 +1,105 @@
+package atlasdata
+
+import (
+	"bytes"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+var update = flag.Bool("update", false, "regenerate the atlasdb testdata payloads")
+
+// messagePayloads are the BubbleWrap framed payloads decoded by the atlasdb
+// golden tests. They are packed from the fixed layouts, independently of the
+// property encoder, to ../atlasdb/testdata/<name>.bin.
+var messagePayloads = []struct {
+	name   string
+	header BubbleWrap
+	msg    interface{}
+}{
+	{
+		name:   "add_remove_entity_ship",
+		header: BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: 834710557},
+		msg: &fAddRemoveEntity{
+			BIsNewEntity: true,
+			TribeEntity: fTribeEntity{
+				EntityID:                                 newUInt32Property("EntityID", 1234567),
+				ParentEntityID:                           newUInt32Property("ParentEntityID", 0),
+				EntityType:                               newByteProperty("EntityType", "ETribeEntityType", "ETribeEntityType::Ship"),
+				ShipType:                                 newByteProperty("ShipType", "EShipType", "EShipType::Brigantine"),
+				EntityName:                               newStringProperty("EntityName", "Black Pearl"),
+				ServerID:                                 newUInt32Property("ServerID", 65537),
+				ServerRelativeLocationInCurrentServerMap: newVector2DProperty("ServerRelativeLocationInCurrentServerMap", FVector2D{X: 0.25, Y: 0.75}),
+				NextAllowedUseTime:                       newUInt32Property("NextAllowedUseTime", 0),
+				BInLandClaimedFlagRange:                  newBoolProperty("bInLandClaimedFlagRange", false),
+				BReachedMaxTravelCount:                   newBoolProperty("bReachedMaxTravelCount", false),
+				BIsDead:                                  newBoolProperty("bIsDead", false),
+			},
+		},
+	},
+	{
+		name:   "add_remove_entity_dead_bed",
+		header: BubbleWrap{ServerVersion: 1, ServerID: 131074, CRC: 834710557},
+		msg: &fAddRemoveEntity{
+			BIsJustLocationChange: true,
+			TribeEntity: fTribeEntity{
+				EntityID:                                 newUInt32Property("EntityID", 7654321),
+				ParentEntityID:                           newUInt32Property("ParentEntityID", 1234567),
+				EntityType:                               newByteProperty("EntityType", "ETribeEntityType", "ETribeEntityType::Bed"),
+				ShipType:                                 newByteProperty("ShipType", "EShipType", "EShipType::None"),
+				EntityName:                               newStringProperty("EntityName", "Bedroll"),
+				ServerID:                                 newUInt32Property("ServerID", 131074),
+				ServerRelativeLocationInCurrentServerMap: newVector2DProperty("ServerRelativeLocationInCurrentServerMap", FVector2D{X: -0.5, Y: 1}),
+				NextAllowedUseTime:                       newUInt32Property("NextAllowedUseTime", 1600000000),
+				BInLandClaimedFlagRange:                  newBoolProperty("bInLandClaimedFlagRange", true),
+				BReachedMaxTravelCount:                   newBoolProperty("bReachedMaxTravelCount", true),
+				BIsDead:                                  newBoolProperty("bIsDead", true),
+			},
+		},
+	},
+	{
+		name:   "chat",
+		header: BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: 156265321},
+		msg: &Chat{
+			SenderName:       NewFString("Jack"),
+			SenderSteamName:  NewFString("jacksparrow"),
+			SenderTribeName:  NewFString("Pirates"),
+			SenderID:         42,
+			Message:          NewFString("Why is the rum gone?"),
+			SenderTeamIndex:  1000,
+			SendMode:         NewFString("TribeChat"),
+			UserID:           NewFString("76561197960287930"),
+			BIsTribeOwner:    true,
+			PlayerBadgeGroup: 2,
+		},
+	},
+	{
+		name:   "member_presence",
+		header: BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: -1646244981},
+		msg:    &MemberPresenceUpdated{PlayerID: 42, LastOnlineAt: 1600000000},
+	},
+}
+
+func TestMessagePayloads(t *testing.T) {
+	for _, fixture := range messagePayloads {
+		t.Run(fixture.name, func(t *testing.T) {
+			path := filepath.Join("..", "atlasdb", "testdata", fixture.name+".bin")
+			packed := append(packFixed(t, &fixture.header), packFixed(t, fixture.msg)...)
+
+			if *update {
+				if err := os.WriteFile(path, packed, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			payload, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, packed) {
+				t.Errorf("%s does not match the fixed layout", path)
+			}
+		})
+	}
+}
@@ -0,0 +1,247 @@
+package atlasdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"testing"
+
+	"github.com/lunixbochs/struc"
+)
+
+// The fixed property layouts below are the original struc mapping of the
+// tribe entity. They are packed independently of MarshalProperties to check
+// the property decoder and encoder against the wire format.
+
+type fProperty struct {
+	Name FString
+	Type FString
+}
+
+// PropertyFlags holds the little endian Size and ArrayIndex of the tag.
+type fStringProperty struct {
+	FProperty     fProperty
+	PropertyFlags uint64
+	Value         FString
+}
+
+// Extra holds the tag Size as its length and the ArrayIndex as its bytes.
+type fUInt32Property struct {
+	FProperty fProperty
+	Extra     FString
+	Value     uint32 `struc:"uint32,little"`
+}
+
+type fVector2DProperty struct {
+	FProperty     fProperty
+	PropertyFlags uint64
+	Extra         FString
+	Value         FVector2D
+}
+
+type fByteProperty struct {
+	FProperty     fProperty
+	PropertyFlags uint64
+	ValueType     FString
+	Value         FString
+}
+
+type fBoolProperty struct {
+	FProperty     fProperty
+	PropertyFlags uint64
+	Value         bool
+}
+
+type fTribeEntity struct {
+	EntityID                                 fUInt32Property
+	ParentEntityID                           fUInt32Property
+	EntityType                               fByteProperty
+	ShipType                                 fByteProperty
+	EntityName                               fStringProperty
+	ServerID                                 fUInt32Property
+	ServerRelativeLocationInCurrentServerMap fVector2DProperty
+	NextAllowedUseTime                       fUInt32Property
+	BInLandClaimedFlagRange                  fBoolProperty
+	BReachedMaxTravelCount                   fBoolProperty
+	BIsDead                                  fBoolProperty
+}
+
+type fAddRemoveEntity struct {
+	BIsNewEntity          bool
+	BIsJustLocationChange bool
+	TribeEntity           fTribeEntity
+}
+
+func newProperty(name, kind string) fProperty {
+	return fProperty{Name: NewFString(name), Type: NewFString(kind)}
+}
+
+// fStringSize is the serialized size of an FString.
+func fStringSize(s FString) uint64 {
+	return uint64(4 + len(s.String))
+}
+
+func newUInt32Property(name string, v uint32) fUInt32Property {
+	return fUInt32Property{
+		FProperty: newProperty(name, "UInt32Property"),
+		Extra:     FString{String: "\u0000\u0000\u0000\u0000"},
+		Value:     v,
+	}
+}
+
+func newStringProperty(name, v string) fStringProperty {
+	value := NewFString(v)
+	return fStringProperty{
+		FProperty:     newProperty(name, "StrProperty"),
+		PropertyFlags: fStringSize(value),
+		Value:         value,
+	}
+}
+
+func newByteProperty(name, enum, v string) fByteProperty {
+	value := NewFString(v)
+	return fByteProperty{
+		FProperty:     newProperty(name, "ByteProperty"),
+		PropertyFlags: fStringSize(value),
+		ValueType:     NewFString(enum),
+		Value:         value,
+	}
+}
+
+func newVector2DProperty(name string, v FVector2D) fVector2DProperty {
+	return fVector2DProperty{
+		FProperty:     newProperty(name, "StructProperty"),
+		PropertyFlags: 8,
+		Extra:         NewFString("Vector2D"),
+		Value:         v,
+	}
+}
+
+func newBoolProperty(name string, v bool) fBoolProperty {
+	return fBoolProperty{FProperty: newProperty(name, "BoolProperty"), Value: v}
+}
+
+// packFixed packs a fixed layout little endian.
+func packFixed(t *testing.T, v interface{}) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	if err := struc.PackWithOptions(buf, v, &struc.Options{Order: binary.LittleEndian}); err != nil {
+		t.Fatalf("struc pack: %v", err)
+	}
+	return buf.Bytes()
+}
+
+func fixedShip() *fAddRemoveEntity {
+	return &fAddRemoveEntity{
+		BIsNewEntity: true,
+		TribeEntity: fTribeEntity{
+			EntityID:                                 newUInt32Property("EntityID", 1234567),
+			ParentEntityID:                           newUInt32Property("ParentEntityID", 0),
+			EntityType:                               newByteProperty("EntityType", "ETribeEntityType", "ETribeEntityType::Ship"),
+			ShipType:                                 newByteProperty("ShipType", "EShipType", "EShipType::Brigantine"),
+			EntityName:                               newStringProperty("EntityName", "Black Pearl"),
+			ServerID:                                 newUInt32Property("ServerID", 65537),
+			ServerRelativeLocationInCurrentServerMap: newVector2DProperty("ServerRelativeLocationInCurrentServerMap", FVector2D{X: 0.25, Y: 0.75}),
+			NextAllowedUseTime:                       newUInt32Property("NextAllowedUseTime", 0),
+			BInLandClaimedFlagRange:                  newBoolProperty("bInLandClaimedFlagRange", false),
+			BReachedMaxTravelCount:                   newBoolProperty("bReachedMaxTravelCount", true),
+			BIsDead:                                  newBoolProperty("bIsDead", false),
+		},
+	}
+}
+
+func TestDecodeFixedTribeEntity(t *testing.T) {
+	payload := packFixed(t, fixedShip())
+
+	got := AddRemoveEntity{}
+	if err := Unpack(bytes.NewReader(payload), &got); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	want := AddRemoveEntity{
+		BIsNewEntity: true,
+		TribeEntity: TribeEntity{
+			EntityID:                                 1234567,
+			EntityType:                               "ETribeEntityType::Ship",
+			ShipType:                                 "EShipType::Brigantine",
+			EntityName:                               "Black Pearl",
+			ServerID:                                 65537,
+			ServerRelativeLocationInCurrentServerMap: FVector2D{X: 0.25, Y: 0.75},
+			BReachedMaxTravelCount:                   true,
+		},
+	}
+	if got != want {
+		t.Errorf("decoded %+v, want %+v", got, want)
+	}
+}
+
+func TestEncodeMatchesFixedTribeEntity(t *testing.T) {
+	want := packFixed(t, fixedShip())
+
+	msg := AddRemoveEntity{}
+	if err := Unpack(bytes.NewReader(want), &msg); err != nil {
+		t.Fatal(err)
+	}
+	got := &bytes.Buffer{}
+	if err := Pack(got, &msg); err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+	if !bytes.Equal(got.Bytes(), want) {
+		t.Errorf("encoding differs from the fixed layout\n got: %x\nwant: %x", got.Bytes(), want)
+	}
+}
+
+func TestDecodeMalformedProperties(t *testing.T) {
+	valid := packFixed(t, fixedShip())
+
+	// property builds a UInt32Property tag claiming size bytes followed by value
+	property := func(size int32, value []byte) []byte {
+		buf := bytes.NewBuffer([]byte{1, 0})
+		WriteFString(buf, "EntityID")
+		WriteFString(buf, "UInt32Property")
+		binary.Write(buf, binary.LittleEndian, []int32{size, 0})
+		buf.Write(value)
+		return buf.Bytes()
+	}
+	// name builds a property name claiming length bytes
+	name := func(length int32) []byte {
+		buf := bytes.NewBuffer([]byte{1, 0})
+		binary.Write(buf, binary.LittleEndian, length)
+		buf.WriteString("EntityID")
+		return buf.Bytes()
+	}
+
+	tests := []struct {
+		name    string
+		payload []byte
+		wantErr bool
+		is      error
+	}{
+		{"empty", nil, true, io.EOF},
+		{"flags only", valid[:2], false, nil},
+		{"truncated value", valid[:len(valid)-3], true, io.ErrUnexpectedEOF},
+		{"truncated tag", valid[:20], true, io.ErrUnexpectedEOF},
+		{"short value", property(4, []byte{1, 2}), true, io.ErrUnexpectedEOF},
+		{"wrong value size", property(2, []byte{1, 2}), true, io.ErrUnexpectedEOF},
+		{"negative size", property(-4, nil), true, nil},
+		{"size past the payload", property(1<<16, []byte{1, 2, 3, 4}), true, io.ErrUnexpectedEOF},
+		{"oversized size", property(MaxLength+1, []byte{1, 2, 3, 4}), true, ErrLengthExceeded},
+		{"name past the payload", name(1 << 16), true, io.ErrUnexpectedEOF},
+		{"oversized name", name(math.MaxInt32), true, ErrLengthExceeded},
+		{"oversized utf16 name", name(math.MinInt32), true, ErrLengthExceeded},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			err := Unpack(bytes.NewReader(test.payload), &AddRemoveEntity{})
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if test.is != nil && !errors.Is(err, test.is) {
+				t.Errorf("expected %v, got %v", test.is, err)
+			}
+		})
+	}
+}
@@ -0,0 +1,394 @@
+package atlasdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"reflect"
+	"strings"
+	"unicode/utf16"
+
+	"github.com/lunixbochs/struc"
+)
+
+// Decoder is implemented by messages which decode themselves rather than
+// relying on a fixed struc layout.
+type Decoder interface {
+	Decode(r io.Reader) error
+}
+
+// Unpack decodes r into v using the Decoder of v when available, falling back
+// to the struc layout.
+func Unpack(r io.Reader, v interface{}) error {
+	if d, ok := v.(Decoder); ok {
+		return d.Decode(r)
+	}
+	return struc.Unpack(r, v)
+}
+
+// PropertyTag is the header preceding each serialized UE property.
+//
+//	+------+------+-------------+-------------------+---------------+-------+
+//	| Name | Type | Size(int32) | ArrayIndex(int32) | [type header] | Value |
+//	+------+------+-------------+-------------------+---------------+-------+
+//
+// StructProperty carries the struct name and ByteProperty/EnumProperty the
+// enum name as the type header. BoolProperty stores its value in the header.
+type PropertyTag struct {
+	Name       string
+	Type       string
+	Size       int32
+	ArrayIndex int32
+	StructName string
+	EnumName   string
+}
+
+// Property is a decoded property tag and its value.
+type Property struct {
+	PropertyTag
+	Value interface{}
+}
+
+// MaxLength bounds the string and property lengths read from a payload, which
+// come from redis and are not trusted.
+const MaxLength = 1 << 20
+
+// ErrLengthExceeded is returned for a string or property longer than
+// MaxLength.
+var ErrLengthExceeded = errors.New("length exceeds the maximum")
+
+// readBytes reads n bytes. Lengths over MaxLength, or over the bytes left in
+// readers reporting their Len such as bytes.Reader, fail before allocating.
+func readBytes(r io.Reader, n int64) ([]byte, error) {
+	if n > MaxLength {
+		return nil, fmt.Errorf("%w: %d bytes", ErrLengthExceeded, n)
+	}
+	if l, ok := r.(interface{ Len() int }); ok && int64(l.Len()) < n {
+		return nil, io.ErrUnexpectedEOF
+	}
+
+	buf := make([]byte, n)
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, unexpected(err)
+	}
+	return buf, nil
+}
+
+// ReadFString reads a length prefixed UE string. Positive lengths are 8-bit
+// strings and negative lengths are UTF-16. Trailing null bytes are removed.
+func ReadFString(r io.Reader) (string, error) {
+	var size int32
+	if err := binary.Read(r, binary.LittleEndian, &size); err != nil {
+		return "", err
+	}
+
+	if size >= 0 {
+		buf, err := readBytes(r, int64(size))
+		if err != nil {
+			return "", err
+		}
+		return strings.TrimRight(string(buf), "\u0000"), nil
+	}
+
+	raw, err := readBytes(r, -int64(size)*2)
+	if err != nil {
+		return "", err
+	}
+	buf := make([]uint16, len(raw)/2)
+	for i := range buf {
+		buf[i] = binary.LittleEndian.Uint16(raw[i*2:])
+	}
+	return strings.TrimRight(string(utf16.Decode(buf)), "\u0000"), nil
+}
+
+// ReadProperty reads the next property from r. io.EOF is returned when the
+// stream ends or the "None" terminator is reached.
+func ReadProperty(r io.Reader) (*Property, error) {
+	p := &Property{}
+	var err error
+
+	if p.Name, err = ReadFString(r); err != nil {
+		return nil, err
+	}
+	if p.Name == "None" || p.Name == "" {
+		return nil, io.EOF
+	}
+
+	if p.Type, err = ReadFString(r); err != nil {
+		return nil, unexpected(err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &p.Size); err != nil {
+		return nil, unexpected(err)
+	}
+	if err := binary.Read(r, binary.LittleEndian, &p.ArrayIndex); err != nil {
+		return nil, unexpected(err)
+	}
+	if p.Size < 0 {
+		return nil, fmt.Errorf("property %s has invalid size %d", p.Name, p.Size)
+	}
+
+	switch p.Type {
+	case "BoolProperty":
+		var v bool
+		if err := binary.Read(r, binary.LittleEndian, &v); err != nil {
+			return nil, unexpected(err)
+		}
+		p.Value = v
+		return p, nil
+	case "StructProperty":
+		if p.StructName, err = ReadFString(r); err != nil {
+			return nil, unexpected(err)
+		}
+	case "ByteProperty", "EnumProperty":
+		if p.EnumName, err = ReadFString(r); err != nil {
+			return nil, unexpected(err)
+		}
+	}
+
+	buf, err := readBytes(r, int64(p.Size))
+	if err != nil {
+		return nil, fmt.Errorf("property %s: %w", p.Name, err)
+	}
+	if p.Value, err = decodePropertyValue(&p.PropertyTag, buf); err != nil {
+		return nil, fmt.Errorf("property %s: %w", p.Name, err)
+	}
+
+	return p, nil
+}
+
+// decodePropertyValue converts the raw value bytes for the known property
+// types. Unknown types are returned as the raw bytes.
+func decodePropertyValue(tag *PropertyTag, buf []byte) (interface{}, error) {
+	r := bytes.NewReader(buf)
+	switch tag.Type {
+	case "StrProperty", "NameProperty":
+		return ReadFString(r)
+	case "ByteProperty":
+		if tag.EnumName == "None" || tag.EnumName == "" {
+			if len(buf) != 1 {
+				return buf, nil
+			}
+			return buf[0], nil
+		}
+		return ReadFString(r)
+	case "EnumProperty":
+		return ReadFString(r)
+	case "StructProperty":
+		switch tag.StructName {
+		case "Vector2D":
+			v := FVector2D{}
+			err := binary.Read(r, binary.LittleEndian, &v)
+			return v, err
+		}
+		return buf, nil
+	}
+
+	var v interface{}
+	switch tag.Type {
+	case "Int8Property":
+		v = new(int8)
+	case "Int16Property":
+		v = new(int16)
+	case "IntProperty":
+		v = new(int32)
+	case "Int64Property":
+		v = new(int64)
+	case "UInt16Property":
+		v = new(uint16)
+	case "UInt32Property":
+		v = new(uint32)
+	case "UInt64Property":
+		v = new(uint64)
+	case "FloatProperty":
+		v = new(float32)
+	case "DoubleProperty":
+		v = new(float64)
+	default:
+		return buf, nil
+	}
+	if err := binary.Read(r, binary.LittleEndian, v); err != nil {
+		return nil, err
+	}
+	return reflect.ValueOf(v).Elem().Interface(), nil
+}
+
+// DecodeProperties reads all properties from r into a map keyed by property
+// name. Array elements past the first are keyed as Name[index].
+func DecodeProperties(r io.Reader) (map[string]interface{}, error) {
+	m := make(map[string]interface{})
+	for {
+		p, err := ReadProperty(r)
+		if err == io.EOF {
+			return m, nil
+		} else if err != nil {
+			return m, err
+		}
+
+		name := p.Name
+		if p.ArrayIndex > 0 {
+			name = fmt.Sprintf("%s[%d]", p.Name, p.ArrayIndex)
+		}
+		m[name] = p.Value
+	}
+}
+
+// UnmarshalProperties reads all properties from r into the struct pointed to
+// by v. Properties are matched case insensitively to fields by the name in the
+// `ue` tag, or the field name. Unknown properties are skipped and fields without a
+// matching property are left untouched. Slice and array fields are filled by
+// the property ArrayIndex.
+func UnmarshalProperties(r io.Reader, v interface{}) error {
+	rv := reflect.ValueOf(v)
+	if rv.Kind() != reflect.Ptr || rv.Elem().Kind() != reflect.Struct {
+		return errors.New("UnmarshalProperties requires a pointer to a struct")
+	}
+	rv = rv.Elem()
+
+	for {
+		p, err := ReadProperty(r)
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		field, ok := propertyField(rv, p.Name)
+		if !ok {
+			continue
+		}
+
+		switch field.Kind() {
+		case reflect.Slice:
+			if field.Type().Elem().Kind() == reflect.Uint8 {
+				err = setPropertyValue(field, p.Value)
+				break
+			}
+			for field.Len() <= int(p.ArrayIndex) {
+				field.Set(reflect.Append(field, reflect.Zero(field.Type().Elem())))
+			}
+			err = setPropertyValue(field.Index(int(p.ArrayIndex)), p.Value)
+		case reflect.Array:
+			if int(p.ArrayIndex) >= field.Len() {
+				continue
+			}
+			err = setPropertyValue(field.Index(int(p.ArrayIndex)), p.Value)
+		default:
+			if p.ArrayIndex > 0 {
+				continue
+			}
+			err = setPropertyValue(field, p.Value)
+		}
+		if err != nil {
+			return fmt.Errorf("property %s: %w", p.Name, err)
+		}
+	}
+}
+
+// propertyField finds the field of the struct matching the property name.
+func propertyField(rv reflect.Value, name string) (reflect.Value, bool) {
+	t := rv.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		opts, ok := fieldOptions(f)
+		if !ok {
+			continue
+		}
+		if opts.Name == name || strings.EqualFold(opts.Name, name) {
+			return rv.Field(i), true
+		}
+	}
+	return reflect.Value{}, false
+}
+
+// propertyOptions are parsed from the `ue:"Name,Type,StructOrEnumName"` tag.
+type propertyOptions struct {
+	Name string
+	Type string
+	Sub  string
+}
+
+// fieldOptions returns the property options for the field. Fields that are
+// unexported or tagged "-" are not properties.
+func fieldOptions(f reflect.StructField) (propertyOptions, bool) {
+	opts := propertyOptions{}
+	tag := f.Tag.Get("ue")
+	if !f.IsExported() || tag == "-" {
+		return opts, false
+	}
+
+	parts := strings.SplitN(tag, ",", 3)
+	opts.Name = parts[0]
+	if opts.Name == "" {
+		opts.Name = f.Name
+	}
+	if len(parts) > 1 {
+		opts.Type = parts[1]
+	}
+	if len(parts) > 2 {
+		opts.Sub = parts[2]
+	}
+	return opts, true
+}
+
+// setPropertyValue assigns the decoded value to the field, converting between
+// numeric types where the value fits.
+func setPropertyValue(field reflect.Value, value interface{}) error {
+	v := reflect.ValueOf(value)
+	if v.Type().AssignableTo(field.Type()) {
+		field.Set(v)
+		return nil
+	}
+
+	switch field.Kind() {
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		switch v.Kind() {
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if !field.OverflowInt(v.Int()) {
+				field.SetInt(v.Int())
+				return nil
+			}
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if v.Uint() <= math.MaxInt64 && !field.OverflowInt(int64(v.Uint())) {
+				field.SetInt(int64(v.Uint()))
+				return nil
+			}
+		}
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		switch v.Kind() {
+		case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+			if !field.OverflowUint(v.Uint()) {
+				field.SetUint(v.Uint())
+				return nil
+			}
+		case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+			if v.Int() >= 0 && !field.OverflowUint(uint64(v.Int())) {
+				field.SetUint(uint64(v.Int()))
+				return nil
+			}
+		}
+	case reflect.Float32, reflect.Float64:
+		switch v.Kind() {
+		case reflect.Float32, reflect.Float64:
+			field.SetFloat(v.Float())
+			return nil
+		}
+	case reflect.String:
+		if v.Kind() == reflect.String {
+			field.SetString(v.String())
+			return nil
+		}
+	}
+
+	return fmt.Errorf("cannot assign %s to %s", v.Type(), field.Type())
+}
+
+// unexpected converts an EOF in the middle of a property to ErrUnexpectedEOF.
+func unexpected(err error) error {
+	if err == io.EOF {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
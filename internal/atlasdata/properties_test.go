@@ -0,0 +1,134 @@
+package atlasdata
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"reflect"
+	"testing"
+)
+
+type allProperties struct {
+	Bool    bool `ue:"bBool"`
+	Int8    int8
+	Int16   int16
+	Int32   int32
+	Int64   int64
+	Byte    uint8
+	UInt16  uint16
+	UInt32  uint32
+	UInt64  uint64
+	Float   float32
+	Double  float64
+	String  string
+	Unicode string
+	Enum    string `ue:",ByteProperty,ETest"`
+	Vector  FVector2D
+	Array   [2]uint32
+	Raw     []byte `ue:",StructProperty,Unknown"`
+}
+
+func TestPropertiesRoundTrip(t *testing.T) {
+	in := allProperties{
+		Bool:    true,
+		Int8:    -8,
+		Int16:   -16,
+		Int32:   -32,
+		Int64:   -64,
+		Byte:    8,
+		UInt16:  16,
+		UInt32:  32,
+		UInt64:  64,
+		Float:   1.5,
+		Double:  2.5,
+		String:  "hello",
+		Unicode: "héllo ⚓",
+		Enum:    "ETest::Value",
+		Vector:  FVector2D{X: 0.5, Y: -0.5},
+		Array:   [2]uint32{1, 2},
+		Raw:     []byte{1, 2, 3},
+	}
+
+	buf := &bytes.Buffer{}
+	if err := MarshalProperties(buf, &in); err != nil {
+		t.Fatalf("MarshalProperties: %v", err)
+	}
+
+	out := allProperties{}
+	if err := UnmarshalProperties(bytes.NewReader(buf.Bytes()), &out); err != nil {
+		t.Fatalf("UnmarshalProperties: %v", err)
+	}
+	if !reflect.DeepEqual(in, out) {
+		t.Errorf("round trip mismatch\n got: %+v\nwant: %+v", out, in)
+	}
+
+	m, err := DecodeProperties(bytes.NewReader(buf.Bytes()))
+	if err != nil {
+		t.Fatalf("DecodeProperties: %v", err)
+	}
+	if m["bBool"] != true || m["Array[1]"] != uint32(2) || m["Enum"] != "ETest::Value" {
+		t.Errorf("unexpected property map %v", m)
+	}
+}
+
+func TestPropertiesUnknownAndMissing(t *testing.T) {
+	in := struct {
+		Extra   uint32
+		Name    string
+		Missing bool `ue:"-"`
+	}{Extra: 7, Name: "ship"}
+
+	buf := &bytes.Buffer{}
+	if err := MarshalProperties(buf, &in); err != nil {
+		t.Fatalf("MarshalProperties: %v", err)
+	}
+	// "None" terminates the property list
+	if err := WriteFString(buf, "None"); err != nil {
+		t.Fatal(err)
+	}
+	buf.WriteString("trailing")
+
+	out := struct {
+		Name    string
+		Missing uint32
+	}{Missing: 3}
+	if err := UnmarshalProperties(bytes.NewReader(buf.Bytes()), &out); err != nil {
+		t.Fatalf("UnmarshalProperties: %v", err)
+	}
+	if out.Name != "ship" || out.Missing != 3 {
+		t.Errorf("unexpected result %+v", out)
+	}
+}
+
+func TestPropertiesTypeMismatch(t *testing.T) {
+	in := struct{ Value string }{"text"}
+	buf := &bytes.Buffer{}
+	if err := MarshalProperties(buf, &in); err != nil {
+		t.Fatal(err)
+	}
+
+	out := struct{ Value uint32 }{}
+	if err := UnmarshalProperties(bytes.NewReader(buf.Bytes()), &out); err == nil {
+		t.Error("expected an error assigning a string to a uint32")
+	}
+}
+
+// Readers without a Len are still bounded by MaxLength.
+func TestReadFStringLength(t *testing.T) {
+	for _, length := range []int32{MaxLength + 1, -MaxLength/2 - 1} {
+		buf := &bytes.Buffer{}
+		binary.Write(buf, binary.LittleEndian, length)
+		r := io.MultiReader(buf, bytes.NewReader([]byte("Jack")))
+		if _, err := ReadFString(r); !errors.Is(err, ErrLengthExceeded) {
+			t.Errorf("length %d: expected ErrLengthExceeded, got %v", length, err)
+		}
+	}
+
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, int32(8))
+	buf.WriteString("Jack")
+	if _, err := ReadFString(io.MultiReader(buf)); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("expected io.ErrUnexpectedEOF for a truncated string, got %v", err)
+	}
+}
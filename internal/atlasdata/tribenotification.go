@@ -1,17 +1,23 @@
 package atlasdata
 
-type fTribeEntity struct {
-	EntityID                                 FUInt32Property
-	ParentEntityID                           FUInt32Property
-	EntityType                               FByteProperty
-	ShipType                                 FByteProperty
-	EntityName                               FStringProperty
-	ServerID                                 FUInt32Property
-	ServerRelativeLocationInCurrentServerMap FVector2DProperty
-	NextAllowedUseTime                       FUInt32Property
-	BInLandClaimedFlagRange                  FBoolProperty
-	BReachedMaxTravelCount                   FBoolProperty
-	BIsDead                                  FBoolProperty
+import (
+	"encoding/binary"
+	"io"
+)
+
+// TribeEntity is the property tagged tribe entity record.
+type TribeEntity struct {
+	EntityID                                 uint32
+	ParentEntityID                           uint32
+	EntityType                               string `ue:",ByteProperty,ETribeEntityType"`
+	ShipType                                 string `ue:",ByteProperty,EShipType"`
+	EntityName                               string
+	ServerID                                 uint32
+	ServerRelativeLocationInCurrentServerMap FVector2D
+	NextAllowedUseTime                       uint32
+	BInLandClaimedFlagRange                  bool `ue:"bInLandClaimedFlagRange"`
+	BReachedMaxTravelCount                   bool `ue:"bReachedMaxTravelCount"`
+	BIsDead                                  bool `ue:"bIsDead"`
 }
 
 type Chat struct {
@@ -31,7 +37,29 @@ type Chat struct {
 type AddRemoveEntity struct {
 	BIsNewEntity          bool `struc:"bool"`
 	BIsJustLocationChange bool `struc:"bool"`
-	TribeEntity           fTribeEntity
+	TribeEntity           TribeEntity
+}
+
+// Decode reads the entity flags followed by the property tagged entity.
+func (a *AddRemoveEntity) Decode(r io.Reader) error {
+	if err := binary.Read(r, binary.LittleEndian, &a.BIsNewEntity); err != nil {
+		return err
+	}
+	if err := binary.Read(r, binary.LittleEndian, &a.BIsJustLocationChange); err != nil {
+		return err
+	}
+	return UnmarshalProperties(r, &a.TribeEntity)
+}
+
+// Encode writes the entity flags followed by the property tagged entity.
+func (a *AddRemoveEntity) Encode(w io.Writer) error {
+	if err := binary.Write(w, binary.LittleEndian, a.BIsNewEntity); err != nil {
+		return err
+	}
+	if err := binary.Write(w, binary.LittleEndian, a.BIsJustLocationChange); err != nil {
+		return err
+	}
+	return MarshalProperties(w, &a.TribeEntity)
 }
 
 type MemberPresenceUpdated struct {
@@ -3,30 +3,191 @@ package atlasdb
 
 import (
 	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"time"
 
 	"github.com/go-redis/redis/v8"
 )
 
 // AtlasDB provides an interface to the Atlas DB
 type AtlasDB struct {
-	db *redis.Client
+	db       redis.UniversalClient
+	dbNumber int
+	tribe    redis.UniversalClient
+	messages *MessageRegistry
+}
+
+// Connection locates a redis server.
+type Connection struct {
+	// Addresses of the redis server, of the sentinels when MasterName is set
+	// or of the cluster nodes when Cluster is set
+	Addresses  []string
+	MasterName string
+	Cluster    bool
+
+	// ACL username, empty for password only authentication
+	Username string
+	Password string
+	DB       int
+
+	// Credentials of the sentinels when they differ from the servers
+	SentinelUsername string
+	SentinelPassword string
+
+	// TLSConfig enables TLS when set
+	TLSConfig *tls.Config
+}
+
+// Options configure the connections to the Atlas redis. Zero timeouts and
+// retries use the redis client defaults.
+type Options struct {
+	Connection
+
+	// Tribe is the server holding tribes, their entities and messages when
+	// ATLAS is configured with a separate TribeDB. Nil uses Connection.
+	Tribe *Connection
+
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+
+	// Commands failing to reach redis are retried with exponential backoff
+	MaxRetries      int
+	MinRetryBackoff time.Duration
+	MaxRetryBackoff time.Duration
+
+	// BreakerThreshold consecutive failures open the circuit breaker for
+	// BreakerCooldown, failing commands with ErrUnavailable. 0 disables it.
+	BreakerThreshold int
+	BreakerCooldown  time.Duration
+
+	// Messages decodes the tribe notifications, nil uses NewMessageRegistry.
+	Messages *MessageRegistry
 }
 
 // NewAtlasDB provides a new DB pool
 func NewAtlasDB(address string, password string, db int) (*AtlasDB, error) {
+	return NewAtlasDBWithOptions(Options{
+		Connection: Connection{
+			Addresses: []string{address},
+			Password:  password,
+			DB:        db,
+		},
+	})
+}
+
+// NewAtlasDBWithOptions provides a new DB pool with timeouts, retries and
+// circuit breaking.
+func NewAtlasDBWithOptions(opts Options) (*AtlasDB, error) {
+	db, err := newClient(opts.Connection, opts)
+	if err != nil {
+		return nil, err
+	}
 	s := &AtlasDB{
-		db: redis.NewClient(&redis.Options{
-			Addr:     address,
-			Password: password,
-			DB:       db,
-		}),
+		db:       db,
+		dbNumber: opts.DB,
+		tribe:    db,
+		messages: opts.Messages,
+	}
+	if s.messages == nil {
+		s.messages = NewMessageRegistry()
+	}
+
+	if opts.Tribe != nil {
+		if s.tribe, err = newClient(*opts.Tribe, opts); err != nil {
+			db.Close()
+			return nil, fmt.Errorf("tribe redis: %w", err)
+		}
+	}
+
+	return s, nil
+}
+
+// NewClient connects to a redis server other than the Atlas redis, such as
+// the session or broker redis, with the client default timeouts.
+func NewClient(c Connection) (redis.UniversalClient, error) {
+	return newClient(c, Options{})
+}
+
+// newClient connects to a standalone server, the master of a sentinel group
+// or a cluster, and tests the connection.
+func newClient(c Connection, opts Options) (redis.UniversalClient, error) {
+	uopts := &redis.UniversalOptions{
+		Addrs:            c.Addresses,
+		MasterName:       c.MasterName,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
+		TLSConfig:        c.TLSConfig,
+		DialTimeout:      opts.DialTimeout,
+		ReadTimeout:      opts.ReadTimeout,
+		WriteTimeout:     opts.WriteTimeout,
+		MaxRetries:       opts.MaxRetries,
+		MinRetryBackoff:  opts.MinRetryBackoff,
+		MaxRetryBackoff:  opts.MaxRetryBackoff,
+	}
+
+	var db redis.UniversalClient
+	switch {
+	case len(c.Addresses) == 0:
+		return nil, errors.New("no redis address")
+	case c.Cluster:
+		if c.MasterName != "" {
+			return nil, errors.New("a redis cluster does not use a sentinel master name")
+		}
+		if c.DB != 0 {
+			return nil, errors.New("a redis cluster only has DB 0")
+		}
+		db = redis.NewClusterClient(uopts.Cluster())
+	case c.MasterName != "":
+		db = redis.NewFailoverClient(uopts.Failover())
+	case len(c.Addresses) == 1:
+		db = redis.NewClient(uopts.Simple())
+	default:
+		return nil, errors.New("multiple redis addresses require a sentinel master name or cluster mode")
+	}
+	if opts.BreakerThreshold > 0 {
+		db.AddHook(newBreaker(opts.BreakerThreshold, opts.BreakerCooldown))
 	}
 
 	// Test connection
-	_, err := s.db.Ping(context.Background()).Result()
-	if err != nil {
+	if _, err := db.Ping(context.Background()).Result(); err != nil {
+		db.Close()
 		return nil, err
 	}
 
-	return s, nil
+	return db, nil
+}
+
+// execPipeline runs the pipeline and returns the errors failing the whole
+// pipeline. Replies such as redis.Nil or WRONGTYPE fail only their command and
+// are left to be checked on each command.
+func execPipeline(ctx context.Context, pipe redis.Pipeliner) error {
+	_, err := pipe.Exec(ctx)
+	var reply redis.Error
+	if errors.As(err, &reply) {
+		return nil
+	}
+	return err
+}
+
+// Close closes the DB pool
+func (s *AtlasDB) Close() error {
+	if s.tribe != s.db {
+		if err := s.tribe.Close(); err != nil {
+			s.db.Close()
+			return err
+		}
+	}
+	return s.db.Close()
+}
+
+// PublishCommand publishes a command to the GeneralNotifications:GlobalCommands
+// channel and returns the number of servers that received it.
+func (s *AtlasDB) PublishCommand(ctx context.Context, command string) (int64, error) {
+	return s.db.Publish(ctx, "GeneralNotifications:GlobalCommands", command).Result()
 }
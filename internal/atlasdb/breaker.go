@@ -0,0 +1,114 @@
+package atlasdb
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+)
+
+// ErrUnavailable is returned without contacting redis while the circuit
+// breaker is open.
+var ErrUnavailable = errors.New("atlas redis unavailable")
+
+// IsUnavailable determines if the error means the Atlas redis could not be
+// reached, as opposed to a failed command or a request that was canceled or
+// ran out of time.
+func IsUnavailable(err error) bool {
+	if canceled(err) {
+		return false
+	}
+	if errors.Is(err, ErrUnavailable) || errors.Is(err, io.EOF) {
+		return true
+	}
+	var netErr net.Error
+	return errors.As(err, &netErr)
+}
+
+// canceled determines if the error comes from the caller's context rather
+// than from redis.
+func canceled(err error) bool {
+	return errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)
+}
+
+// breaker is a redis hook failing commands fast with ErrUnavailable after
+// threshold consecutive connection failures. Once the cooldown has passed
+// commands are let through again; a success closes the breaker and a failure
+// opens it for another cooldown.
+type breaker struct {
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int
+	openUntil time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown}
+}
+
+func (b *breaker) allow() error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if time.Now().Before(b.openUntil) {
+		return ErrUnavailable
+	}
+	return nil
+}
+
+func (b *breaker) record(err error) {
+	// Replies from redis, including nil replies, show it is reachable
+	var redisErr redis.Error
+	if errors.Is(err, ErrUnavailable) || canceled(err) {
+		return
+	}
+	failed := err != nil && !errors.As(err, &redisErr)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		if b.failures >= b.threshold {
+			log.Info().Msg("atlas redis available")
+		}
+		b.failures = 0
+		return
+	}
+
+	b.failures++
+	if b.failures >= b.threshold {
+		if b.failures == b.threshold {
+			log.Error().Err(err).Msg("atlas redis unavailable, opening circuit breaker")
+		}
+		b.openUntil = time.Now().Add(b.cooldown)
+	}
+}
+
+func (b *breaker) BeforeProcess(ctx context.Context, cmd redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *breaker) AfterProcess(ctx context.Context, cmd redis.Cmder) error {
+	b.record(cmd.Err())
+	return nil
+}
+
+func (b *breaker) BeforeProcessPipeline(ctx context.Context, cmds []redis.Cmder) (context.Context, error) {
+	return ctx, b.allow()
+}
+
+func (b *breaker) AfterProcessPipeline(ctx context.Context, cmds []redis.Cmder) error {
+	var err error
+	for _, cmd := range cmds {
+		if err = cmd.Err(); err != nil {
+			break
+		}
+	}
+	b.record(err)
+	return nil
+}
@@ -0,0 +1,58 @@
+package atlasdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+)
+
+func TestIsUnavailable(t *testing.T) {
+	tests := []struct {
+		err  error
+		want bool
+	}{
+		{ErrUnavailable, true},
+		{io.EOF, true},
+		{&net.OpError{Op: "dial", Err: errors.New("connection refused")}, true},
+		{fmt.Errorf("loading: %w", &net.OpError{Op: "read", Err: errors.New("reset")}), true},
+		{redis.Nil, false},
+		{context.Canceled, false},
+		{context.DeadlineExceeded, false},
+		{fmt.Errorf("loading: %w", context.DeadlineExceeded), false},
+		{nil, false},
+	}
+	for _, test := range tests {
+		if got := IsUnavailable(test.err); got != test.want {
+			t.Errorf("IsUnavailable(%v) = %v, want %v", test.err, got, test.want)
+		}
+	}
+}
+
+func TestBreaker(t *testing.T) {
+	b := newBreaker(2, time.Minute)
+	netErr := &net.OpError{Op: "dial", Err: errors.New("connection refused")}
+
+	// Canceled requests and redis replies do not count
+	b.record(netErr)
+	b.record(context.Canceled)
+	b.record(context.DeadlineExceeded)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker opened by canceled requests: %v", err)
+	}
+	b.record(redis.Nil)
+	b.record(netErr)
+	if err := b.allow(); err != nil {
+		t.Fatalf("breaker opened after a reply reset the failures: %v", err)
+	}
+
+	b.record(netErr)
+	if err := b.allow(); !errors.Is(err, ErrUnavailable) {
+		t.Errorf("breaker not opened after the threshold, got %v", err)
+	}
+}
@@ -0,0 +1,203 @@
+package atlasdb
+
+import (
+	"context"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+)
+
+// maxEntityScanBatches bounds the SCAN calls of one ScanEntities call so that
+// rare filters return partial pages rather than walking the whole keyspace.
+const maxEntityScanBatches = 10
+
+// EntityInfo is an entityinfo record of any tribe.
+type EntityInfo struct {
+	EntityID           uint32  `redis:"EntityID"`
+	ParentEntityID     uint32  `redis:"ParentEntityID"`
+	TribeID            int64   `redis:"TribeID"`
+	EntityType         string  `redis:"EntityType"`
+	ShipType           string  `redis:"ShipType"`
+	EntityName         string  `redis:"EntityName"`
+	ServerID           uint32  `redis:"ServerId"`
+	X                  float32 `redis:"ServerXRelativeLocation"`
+	Y                  float32 `redis:"ServerYRelativeLocation"`
+	IsDead             bool    `redis:"bIsDead"`
+	LastUpdatedDBAt    uint64  `redis:"LastUpdatedDBAt"`
+	NextAllowedUseTime uint64  `redis:"NextAllowedUseTime"`
+}
+
+// EntityQuery filters entities. Each non empty field must match. Entity and
+// ship types are matched case insensitively, with or without their enum
+// prefix.
+type EntityQuery struct {
+	EntityTypes []string
+	ShipTypes   []string
+	ServerIDs   []uint32
+	TribeIDs    []int64
+}
+
+// Match determines if the entity passes the query.
+func (q *EntityQuery) Match(e *EntityInfo) bool {
+	if len(q.EntityTypes) > 0 && !matchEnum(q.EntityTypes, e.EntityType, "ETribeEntityType::") {
+		return false
+	}
+	if len(q.ShipTypes) > 0 && !matchEnum(q.ShipTypes, e.ShipType, "EShipType::") {
+		return false
+	}
+	if len(q.ServerIDs) > 0 && !matchServerID(q.ServerIDs, e.ServerID) {
+		return false
+	}
+	if len(q.TribeIDs) > 0 && !matchTribeID(q.TribeIDs, e.TribeID) {
+		return false
+	}
+	return true
+}
+
+func matchServerID(list []uint32, id uint32) bool {
+	for _, l := range list {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+func matchTribeID(list []int64, id int64) bool {
+	for _, l := range list {
+		if l == id {
+			return true
+		}
+	}
+	return false
+}
+
+func matchEnum(list []string, value, prefix string) bool {
+	value = strings.TrimPrefix(value, prefix)
+	for _, l := range list {
+		if strings.EqualFold(strings.TrimPrefix(l, prefix), value) {
+			return true
+		}
+	}
+	return false
+}
+
+// ScanEntities walks the entityinfo keys of the cluster from the SCAN cursor
+// and returns the entities matching the query. As with SCAN, count is a hint:
+// batches are read until at least count entities match, the keyspace ends or
+// the batch limit is reached. The returned cursor continues the walk and is 0
+// once complete. Queries for tribes walk the entity sets of the tribes
+// instead.
+func (s *AtlasDB) ScanEntities(ctx context.Context, cursor uint64, count int64, q EntityQuery) ([]EntityInfo, uint64, error) {
+	if len(q.TribeIDs) > 0 {
+		return s.scanTribeEntities(ctx, cursor, count, q)
+	}
+
+	entities := []EntityInfo{}
+	for batch := 0; batch < maxEntityScanBatches; batch++ {
+		keys, next, err := scanKeys(ctx, s.tribe, cursor, "entityinfo:*", count)
+		if err != nil {
+			return nil, cursor, err
+		}
+		cursor = next
+
+		found, err := s.getEntities(ctx, keys)
+		if err != nil {
+			return nil, cursor, err
+		}
+		for i := range found {
+			if q.Match(&found[i]) {
+				entities = append(entities, found[i])
+			}
+		}
+
+		if cursor == 0 || int64(len(entities)) >= count {
+			break
+		}
+	}
+	return entities, cursor, nil
+}
+
+// scanTribeEntities pages through the entity sets of the query's tribes. The
+// cursor is the offset into their sorted entity IDs.
+func (s *AtlasDB) scanTribeEntities(ctx context.Context, cursor uint64, count int64, q EntityQuery) ([]EntityInfo, uint64, error) {
+	ids := []int64{}
+	for _, tribeID := range q.TribeIDs {
+		list, err := s.GetTribeEntityIDList(ctx, tribeID)
+		if err != nil {
+			return nil, cursor, err
+		}
+		ids = append(ids, list...)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	entities := []EntityInfo{}
+	for batch := 0; batch < maxEntityScanBatches && cursor < uint64(len(ids)); batch++ {
+		end := cursor + uint64(count)
+		if end > uint64(len(ids)) {
+			end = uint64(len(ids))
+		}
+		keys := make([]string, 0, end-cursor)
+		for _, id := range ids[cursor:end] {
+			keys = append(keys, "entityinfo:"+strconv.FormatInt(id, 10))
+		}
+		cursor = end
+
+		found, err := s.getEntities(ctx, keys)
+		if err != nil {
+			return nil, cursor, err
+		}
+		for i := range found {
+			if q.Match(&found[i]) {
+				entities = append(entities, found[i])
+			}
+		}
+
+		if int64(len(entities)) >= count {
+			break
+		}
+	}
+
+	if cursor >= uint64(len(ids)) {
+		cursor = 0
+	}
+	return entities, cursor, nil
+}
+
+// getEntities loads the entityinfo keys in a pipeline. Keys removed since they
+// were listed, or that fail to load, are left out.
+func (s *AtlasDB) getEntities(ctx context.Context, keys []string) ([]EntityInfo, error) {
+	if len(keys) == 0 {
+		return nil, nil
+	}
+
+	pipe := s.tribe.Pipeline()
+	cmds := make([]*redis.StringStringMapCmd, 0, len(keys))
+	for _, key := range keys {
+		cmds = append(cmds, pipe.HGetAll(ctx, key))
+	}
+	if err := execPipeline(ctx, pipe); err != nil {
+		return nil, err
+	}
+
+	entities := make([]EntityInfo, 0, len(keys))
+	for i, cmd := range cmds {
+		if err := cmd.Err(); err != nil {
+			log.Error().Err(err).Msgf("loading %s", keys[i])
+			continue
+		}
+		if len(cmd.Val()) == 0 {
+			continue
+		}
+		e := EntityInfo{}
+		if err := cmd.Scan(&e); err != nil {
+			log.Error().Err(err).Msgf("scanning %s", keys[i])
+			continue
+		}
+		entities = append(entities, e)
+	}
+	return entities, nil
+}
@@ -0,0 +1,66 @@
+package atlasdb
+
+import (
+	"context"
+	"testing"
+)
+
+// scanAll pages through ScanEntities until the cursor returns to 0.
+func scanAll(t *testing.T, db *AtlasDB, count int64, q EntityQuery) []EntityInfo {
+	t.Helper()
+	var (
+		all    []EntityInfo
+		cursor uint64
+	)
+	for pages := 0; pages < 100; pages++ {
+		entities, next, err := db.ScanEntities(context.Background(), cursor, count, q)
+		if err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, entities...)
+		if cursor = next; cursor == 0 {
+			return all
+		}
+	}
+	t.Fatal("scan did not complete")
+	return nil
+}
+
+func TestScanEntities(t *testing.T) {
+	db, mr := newTestDB(t)
+	mr.HSet("entityinfo:1", "EntityID", "1", "TribeID", "100", "EntityType", "ETribeEntityType::Ship")
+	mr.HSet("entityinfo:2", "EntityID", "2", "TribeID", "100", "EntityType", "ETribeEntityType::Bed")
+	mr.HSet("entityinfo:3", "EntityID", "3", "TribeID", "100", "EntityType", "ETribeEntityType::Ship")
+	mr.HSet("entityinfo:4", "EntityID", "4", "TribeID", "200", "EntityType", "ETribeEntityType::Ship")
+	mr.Set("entityinfo:5", "WRONGTYPE")
+	mr.SAdd("tribedata.entities:100", "1", "2", "3", "5", "6")
+	mr.SAdd("tribedata.entities:200", "4")
+
+	tests := []struct {
+		name  string
+		count int64
+		q     EntityQuery
+		want  map[uint32]bool
+	}{
+		{"all", 2, EntityQuery{}, map[uint32]bool{1: true, 2: true, 3: true, 4: true}},
+		{"entity type", 10, EntityQuery{EntityTypes: []string{"ship"}}, map[uint32]bool{1: true, 3: true, 4: true}},
+		{"tribe", 1, EntityQuery{TribeIDs: []int64{100}}, map[uint32]bool{1: true, 2: true, 3: true}},
+		{"tribes", 2, EntityQuery{TribeIDs: []int64{100, 200}}, map[uint32]bool{1: true, 2: true, 3: true, 4: true}},
+		{"tribe and type", 10, EntityQuery{TribeIDs: []int64{100}, EntityTypes: []string{"Bed"}}, map[uint32]bool{2: true}},
+		{"unknown tribe", 10, EntityQuery{TribeIDs: []int64{300}}, map[uint32]bool{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := scanAll(t, db, test.count, test.q)
+			if len(got) != len(test.want) {
+				t.Fatalf("got %+v, want entities %v", got, test.want)
+			}
+			for _, e := range got {
+				if !test.want[e.EntityID] {
+					t.Errorf("unexpected entity %+v", e)
+				}
+			}
+		})
+	}
+}
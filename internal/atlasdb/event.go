@@ -0,0 +1,78 @@
+package atlasdb
+
+import (
+	"encoding/json"
+	"reflect"
+	"time"
+)
+
+// EventKind identifies the type of payload carried by an Event.
+type EventKind string
+
+// Event kinds sent to tribe subscribers.
+const (
+	EventEntityUpdate   EventKind = "entity"
+	EventChat           EventKind = "chat"
+	EventMemberPresence EventKind = "presence"
+	EventSnapshot       EventKind = "snapshot"
+)
+
+// Event is the envelope for all data sent to event subscribers. Payload holds
+// the decoded message for the Kind.
+type Event struct {
+	// ID orders the events of a tribe stream, empty for events that cannot be
+	// resumed.
+	ID string `json:",omitempty"`
+
+	// TribeID is the tribe the event was delivered for.
+	TribeID int64 `json:",omitempty"`
+
+	Kind      EventKind
+	ServerID  uint32
+	Timestamp time.Time
+	Payload   interface{}
+}
+
+// NewEvent creates a new event stamped with the current time.
+func NewEvent(kind EventKind, serverID uint32, payload interface{}) Event {
+	return Event{
+		Kind:      kind,
+		ServerID:  serverID,
+		Timestamp: time.Now().UTC(),
+		Payload:   payload,
+	}
+}
+
+// eventPayloads maps the built in event kinds to their payload types so that
+// events can be decoded from JSON.
+var eventPayloads = map[EventKind]reflect.Type{
+	EventEntityUpdate:   reflect.TypeOf(TribeEntityUpdate{}),
+	EventChat:           reflect.TypeOf(TribeChat{}),
+	EventMemberPresence: reflect.TypeOf(TribeMemberPresence{}),
+	EventSnapshot:       reflect.TypeOf(TribeSnapshot{}),
+}
+
+// UnmarshalJSON decodes the payload into its type for the built in kinds.
+// Payloads of other kinds are kept as json.RawMessage.
+func (e *Event) UnmarshalJSON(data []byte) error {
+	type event Event
+	raw := struct {
+		*event
+		Payload json.RawMessage
+	}{event: (*event)(e)}
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	t, ok := eventPayloads[e.Kind]
+	if !ok {
+		e.Payload = raw.Payload
+		return nil
+	}
+	v := reflect.New(t)
+	if err := json.Unmarshal(raw.Payload, v.Interface()); err != nil {
+		return err
+	}
+	e.Payload = v.Elem().Interface()
+	return nil
+}
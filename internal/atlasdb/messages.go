@@ -0,0 +1,205 @@
+package atlasdb
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/antihax/AtlasMap/internal/atlasdata"
+	"github.com/lunixbochs/struc"
+)
+
+// ErrUnknownMessage is returned when no message type is registered for a CRC.
+var ErrUnknownMessage = errors.New("unknown message crc")
+
+// bubbleWrapSize is the packed size of atlasdata.BubbleWrap.
+const bubbleWrapSize = 12
+
+// MessageType describes how a tribe notification is decoded and turned into
+// an event.
+type MessageType struct {
+	// Kind of the event produced by the message.
+	Kind EventKind
+
+	// Message is a pointer to the atlasdata struct the payload is unpacked into.
+	// A new value of the same type is created for every message.
+	Message interface{}
+
+	// Transform converts the unpacked message into the event payload. A nil
+	// payload drops the message. When Transform is nil the unpacked message is
+	// used as the payload.
+	Transform func(msg interface{}) (interface{}, error)
+}
+
+// MessageRegistry maps tribe notification CRCs to their message types.
+type MessageRegistry struct {
+	mu    sync.RWMutex
+	types map[int32]MessageType
+}
+
+// NewMessageRegistry creates a registry holding the built in message types.
+func NewMessageRegistry() *MessageRegistry {
+	r := &MessageRegistry{
+		types: make(map[int32]MessageType),
+	}
+
+	r.mustRegister(-1646244981, MessageType{
+		Kind:      EventMemberPresence,
+		Message:   &atlasdata.MemberPresenceUpdated{},
+		Transform: transformMemberPresence,
+	})
+	r.mustRegister(156265321, MessageType{
+		Kind:      EventChat,
+		Message:   &atlasdata.Chat{},
+		Transform: transformChat,
+	})
+	r.mustRegister(834710557, MessageType{
+		Kind:      EventEntityUpdate,
+		Message:   &atlasdata.AddRemoveEntity{},
+		Transform: transformAddRemoveEntity,
+	})
+
+	// The tribe log, 1652749511, and remove entity, 1466483860, notifications
+	// are not decoded until their layout is confirmed from a capture made with
+	// tribecapture.
+
+	return r
+}
+
+// Register adds or replaces the message type for the CRC.
+func (r *MessageRegistry) Register(crc int32, t MessageType) error {
+	if t.Kind == "" {
+		return errors.New("message type requires a kind")
+	}
+	v := reflect.ValueOf(t.Message)
+	if v.Kind() != reflect.Ptr || v.IsNil() || v.Elem().Kind() != reflect.Struct {
+		return errors.New("message type requires a pointer to a struct")
+	}
+
+	r.mu.Lock()
+	r.types[crc] = t
+	r.mu.Unlock()
+	return nil
+}
+
+func (r *MessageRegistry) mustRegister(crc int32, t MessageType) {
+	if err := r.Register(crc, t); err != nil {
+		panic(err)
+	}
+}
+
+// Unregister removes the message type for the CRC.
+func (r *MessageRegistry) Unregister(crc int32) {
+	r.mu.Lock()
+	delete(r.types, crc)
+	r.mu.Unlock()
+}
+
+// Lookup returns the message type registered for the CRC.
+func (r *MessageRegistry) Lookup(crc int32) (MessageType, bool) {
+	r.mu.RLock()
+	defer r.mu.RUnlock()
+	t, ok := r.types[crc]
+	return t, ok
+}
+
+// Decode unpacks a BubbleWrap framed tribe message into an event. A nil event
+// is returned when the transform drops the message. ErrUnknownMessage is
+// returned, along with the header, for unregistered CRCs.
+func (r *MessageRegistry) Decode(payload string) (*Event, *atlasdata.BubbleWrap, error) {
+	if len(payload) < bubbleWrapSize {
+		return nil, nil, fmt.Errorf("payload too short: %d bytes", len(payload))
+	}
+
+	header := &atlasdata.BubbleWrap{}
+	if err := struc.Unpack(strings.NewReader(payload[:bubbleWrapSize]), header); err != nil {
+		return nil, nil, err
+	}
+
+	t, ok := r.Lookup(header.CRC)
+	if !ok {
+		return nil, header, fmt.Errorf("%w %d", ErrUnknownMessage, header.CRC)
+	}
+
+	msg := reflect.New(reflect.TypeOf(t.Message).Elem()).Interface()
+	if err := atlasdata.Unpack(strings.NewReader(payload[bubbleWrapSize:]), msg); err != nil {
+		return nil, header, err
+	}
+
+	var data interface{} = msg
+	if t.Transform != nil {
+		var err error
+		if data, err = t.Transform(msg); err != nil {
+			return nil, header, err
+		}
+	}
+	if data == nil {
+		return nil, header, nil
+	}
+
+	e := NewEvent(t.Kind, header.ServerID, data)
+	return &e, header, nil
+}
+
+// DecodeTribeMessage decodes a raw message into an event for the tribe of its
+// channel, stamped with the time the message was received. A nil event is
+// returned when the transform drops the message. ErrUnknownMessage is
+// returned, along with the header, for unregistered CRCs.
+func (r *MessageRegistry) DecodeTribeMessage(msg RawTribeMessage) (*TribeEvent, *atlasdata.BubbleWrap, error) {
+	tribeID, err := strconv.ParseInt(strings.TrimPrefix(msg.Channel, "tribemsg:"), 10, 64)
+	if err != nil {
+		return nil, nil, fmt.Errorf("tribe channel %s: %w", msg.Channel, err)
+	}
+
+	e, header, err := r.Decode(string(msg.Payload))
+	if err != nil || e == nil {
+		return nil, header, err
+	}
+	e.Timestamp = msg.Time
+	return &TribeEvent{TribeID: tribeID, Event: *e}, header, nil
+}
+
+// RegisterMessage adds or replaces the decoder for a tribe notification CRC.
+func (s *AtlasDB) RegisterMessage(crc int32, t MessageType) error {
+	return s.messages.Register(crc, t)
+}
+
+func transformMemberPresence(msg interface{}) (interface{}, error) {
+	b := msg.(*atlasdata.MemberPresenceUpdated)
+	return TribeMemberPresence{
+		PlayerID:     b.PlayerID,
+		LastOnlineAt: b.LastOnlineAt,
+	}, nil
+}
+
+func transformChat(msg interface{}) (interface{}, error) {
+	b := msg.(*atlasdata.Chat)
+	return TribeChat{
+		SenderName:      trimFString(b.SenderName),
+		SenderSteamName: trimFString(b.SenderSteamName),
+		SenderTribeName: trimFString(b.SenderTribeName),
+		SenderID:        b.SenderID,
+		Message:         trimFString(b.Message),
+		SendMode:        trimFString(b.SendMode),
+		IsTribeOwner:    b.BIsTribeOwner,
+	}, nil
+}
+
+func transformAddRemoveEntity(msg interface{}) (interface{}, error) {
+	// Hack to deal with inconsistent types
+	e := &msg.(*atlasdata.AddRemoveEntity).TribeEntity
+	return TribeEntityUpdate{
+		EntityID:       e.EntityID,
+		ParentEntityID: e.ParentEntityID,
+		EntityType:     strings.TrimPrefix(e.EntityType, "ETribeEntityType::"),
+		ShipType:       strings.TrimPrefix(e.ShipType, "EShipType::"),
+		EntityName:     e.EntityName,
+		ServerID:       e.ServerID,
+		X:              e.ServerRelativeLocationInCurrentServerMap.X,
+		Y:              e.ServerRelativeLocationInCurrentServerMap.Y,
+		IsDead:         e.BIsDead,
+	}, nil
+}
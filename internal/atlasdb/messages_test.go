@@ -0,0 +1,214 @@
+package atlasdb
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/antihax/AtlasMap/internal/atlasdata"
+)
+
+var update = flag.Bool("update", false, "regenerate the golden files")
+
+// messageFixtures are the messages packed in testdata/<name>.bin, which the
+// atlasdata tests generate from the fixed layouts. They are decoded to
+// testdata/<name>.golden.json and must encode to the same bytes.
+var messageFixtures = []struct {
+	name   string
+	header atlasdata.BubbleWrap
+	msg    interface{}
+}{
+	{
+		name:   "add_remove_entity_ship",
+		header: atlasdata.BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: 834710557},
+		msg: &atlasdata.AddRemoveEntity{
+			BIsNewEntity: true,
+			TribeEntity: atlasdata.TribeEntity{
+				EntityID:                                 1234567,
+				ParentEntityID:                           0,
+				EntityType:                               "ETribeEntityType::Ship",
+				ShipType:                                 "EShipType::Brigantine",
+				EntityName:                               "Black Pearl",
+				ServerID:                                 65537,
+				ServerRelativeLocationInCurrentServerMap: atlasdata.FVector2D{X: 0.25, Y: 0.75},
+				NextAllowedUseTime:                       0,
+				BInLandClaimedFlagRange:                  false,
+				BReachedMaxTravelCount:                   false,
+				BIsDead:                                  false,
+			},
+		},
+	},
+	{
+		name:   "add_remove_entity_dead_bed",
+		header: atlasdata.BubbleWrap{ServerVersion: 1, ServerID: 131074, CRC: 834710557},
+		msg: &atlasdata.AddRemoveEntity{
+			BIsJustLocationChange: true,
+			TribeEntity: atlasdata.TribeEntity{
+				EntityID:                                 7654321,
+				ParentEntityID:                           1234567,
+				EntityType:                               "ETribeEntityType::Bed",
+				ShipType:                                 "EShipType::None",
+				EntityName:                               "Bedroll",
+				ServerID:                                 131074,
+				ServerRelativeLocationInCurrentServerMap: atlasdata.FVector2D{X: -0.5, Y: 1},
+				NextAllowedUseTime:                       1600000000,
+				BInLandClaimedFlagRange:                  true,
+				BReachedMaxTravelCount:                   true,
+				BIsDead:                                  true,
+			},
+		},
+	},
+	{
+		name:   "chat",
+		header: atlasdata.BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: 156265321},
+		msg: &atlasdata.Chat{
+			SenderName:       atlasdata.NewFString("Jack"),
+			SenderSteamName:  atlasdata.NewFString("jacksparrow"),
+			SenderTribeName:  atlasdata.NewFString("Pirates"),
+			SenderID:         42,
+			Message:          atlasdata.NewFString("Why is the rum gone?"),
+			SenderTeamIndex:  1000,
+			SendMode:         atlasdata.NewFString("TribeChat"),
+			UserID:           atlasdata.NewFString("76561197960287930"),
+			BIsTribeOwner:    true,
+			PlayerBadgeGroup: 2,
+		},
+	},
+	{
+		name:   "member_presence",
+		header: atlasdata.BubbleWrap{ServerVersion: 1, ServerID: 65537, CRC: -1646244981},
+		msg: &atlasdata.MemberPresenceUpdated{
+			PlayerID:     42,
+			LastOnlineAt: 1600000000,
+		},
+	},
+}
+
+func TestMessageGoldenFiles(t *testing.T) {
+	registry := NewMessageRegistry()
+
+	for _, fixture := range messageFixtures {
+		t.Run(fixture.name, func(t *testing.T) {
+			binPath := filepath.Join("testdata", fixture.name+".bin")
+			goldenPath := filepath.Join("testdata", fixture.name+".golden.json")
+
+			encoded, err := atlasdata.PackMessage(fixture.header, fixture.msg)
+			if err != nil {
+				t.Fatalf("PackMessage: %v", err)
+			}
+
+			payload, err := os.ReadFile(binPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(payload, encoded) {
+				t.Errorf("encoding does not match %s", binPath)
+			}
+
+			e, header, err := registry.Decode(string(payload))
+			if err != nil {
+				t.Fatalf("Decode: %v", err)
+			}
+			if *header != fixture.header {
+				t.Errorf("header = %+v, want %+v", *header, fixture.header)
+			}
+			if e == nil {
+				t.Fatal("Decode dropped the message")
+			}
+
+			// Timestamps are the time of decoding and are left out
+			got, err := json.MarshalIndent(struct {
+				Kind     EventKind
+				ServerID uint32
+				Payload  interface{}
+			}{e.Kind, e.ServerID, e.Payload}, "", "\t")
+			if err != nil {
+				t.Fatal(err)
+			}
+			got = append(got, '\n')
+
+			if *update {
+				if err := os.WriteFile(goldenPath, got, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			want, err := os.ReadFile(goldenPath)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, want) {
+				t.Errorf("decoded event does not match %s\ngot:\n%s\nwant:\n%s", goldenPath, got, want)
+			}
+		})
+	}
+}
+
+func TestMessageDecodeUnknownCRC(t *testing.T) {
+	payload, err := atlasdata.PackMessage(atlasdata.BubbleWrap{CRC: 1}, &atlasdata.MemberPresenceUpdated{PlayerID: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, header, err := NewMessageRegistry().Decode(string(payload))
+	if err == nil || header == nil || header.CRC != 1 {
+		t.Fatalf("expected ErrUnknownMessage with header, got %v %v", header, err)
+	}
+}
+
+func TestMessageDecodeTruncated(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "add_remove_entity_ship.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if _, _, err := NewMessageRegistry().Decode(string(payload[:len(payload)-3])); err == nil {
+		t.Fatal("expected an error decoding a truncated payload")
+	}
+}
+
+// The original decoder copied ShipType into EntityType.
+func TestTransformAddRemoveEntityTypes(t *testing.T) {
+	v, err := transformAddRemoveEntity(&atlasdata.AddRemoveEntity{
+		TribeEntity: atlasdata.TribeEntity{
+			EntityType: "ETribeEntityType::Ship",
+			ShipType:   "EShipType::Schooner",
+		},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	e := v.(TribeEntityUpdate)
+	if e.EntityType != "Ship" || e.ShipType != "Schooner" {
+		t.Errorf("EntityType = %q, ShipType = %q, want Ship and Schooner", e.EntityType, e.ShipType)
+	}
+}
+
+func TestDecodeTribeMessage(t *testing.T) {
+	payload, err := os.ReadFile(filepath.Join("testdata", "chat.bin"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	received := time.Date(2020, 9, 13, 12, 26, 40, 0, time.UTC)
+
+	e, header, err := NewMessageRegistry().DecodeTribeMessage(RawTribeMessage{
+		Time:    received,
+		Channel: "tribemsg:1000000001",
+		Payload: payload,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.CRC != chatCRC || e.TribeID != 1000000001 || e.Event.Kind != EventChat || !e.Event.Timestamp.Equal(received) {
+		t.Errorf("unexpected event %+v", e)
+	}
+
+	if _, _, err := NewMessageRegistry().DecodeTribeMessage(RawTribeMessage{Channel: "tribemsg:abc", Payload: payload}); err == nil {
+		t.Error("expected an error for a channel without a tribe ID")
+	}
+}
@@ -2,9 +2,12 @@ package atlasdb
 
 import (
 	"context"
+	"errors"
+	"fmt"
 	"strconv"
 	"strings"
 
+	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog/log"
 )
 
@@ -24,6 +27,35 @@ func (s *AtlasDB) GetPlayerServerInfoFromSteamID(ctx context.Context, steamID st
 	return p, nil
 }
 
+// GetPlayerServerInfos returns the PlayerServerInfo of each steamID in a
+// single pipeline. Players without server info are left out.
+func (s *AtlasDB) GetPlayerServerInfos(ctx context.Context, steamIDs []string) (map[string]*PlayerServerInfo, error) {
+	pipe := s.db.Pipeline()
+	cmds := make(map[string]*redis.StringStringMapCmd, len(steamIDs))
+	for _, steamID := range steamIDs {
+		cmds[steamID] = pipe.HGetAll(ctx, "playerserverinfo:"+steamID)
+	}
+	if len(cmds) == 0 {
+		return map[string]*PlayerServerInfo{}, nil
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, err
+	}
+
+	infos := make(map[string]*PlayerServerInfo, len(cmds))
+	for steamID, cmd := range cmds {
+		p := &PlayerServerInfo{}
+		if err := cmd.Scan(p); err != nil {
+			log.Error().Err(err).Msg("scanning playerserverinfo")
+			continue
+		}
+		if p.PlayerID != "" {
+			infos[steamID] = p
+		}
+	}
+	return infos, nil
+}
+
 type PlayerInfo struct {
 	PlayerID     int64  `redis:"PlayerId"`
 	TribeID      int64  `redis:"TribeID"`
@@ -41,27 +73,204 @@ func (s *AtlasDB) GetPlayerInfoFromPlayerID(ctx context.Context, playerID int64)
 	return p, nil
 }
 
-// GetPlayerSteamID returns the SteamID of a playerID.
+// GetTribeMembers returns the PlayerInfo of the players belonging to the
+// tribe. ATLAS does not index tribe members so the candidate playerIDs, see
+// GetPlayerTribeIDs, are fetched in pipelined batches and filtered by TribeID.
+func (s *AtlasDB) GetTribeMembers(ctx context.Context, tribeID int64, playerIDs []int64) ([]*PlayerInfo, error) {
+	const batchSize = 500
+	members := []*PlayerInfo{}
+
+	for start := 0; start < len(playerIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(playerIDs) {
+			end = len(playerIDs)
+		}
+
+		pipe := s.db.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, 0, end-start)
+		for _, id := range playerIDs[start:end] {
+			cmds = append(cmds, pipe.HGetAll(ctx, "playerinfo:"+strconv.FormatInt(id, 10)))
+		}
+		if err := execPipeline(ctx, pipe); err != nil {
+			return nil, err
+		}
+
+		for _, cmd := range cmds {
+			p := &PlayerInfo{}
+			if err := cmd.Err(); err != nil {
+				log.Error().Err(err).Msg("loading playerinfo")
+				continue
+			}
+			if err := cmd.Scan(p); err != nil {
+				log.Error().Err(err).Msg("scanning playerinfo")
+				continue
+			}
+			if p.TribeID == tribeID && p.PlayerID != 0 {
+				members = append(members, p)
+			}
+		}
+	}
+
+	return members, nil
+}
+
+// GetPlayerTribeIDs returns the TribeID of each player, 0 for players without
+// a tribe. Players without playerinfo are left out.
+func (s *AtlasDB) GetPlayerTribeIDs(ctx context.Context, playerIDs []int64) (map[int64]int64, error) {
+	const batchSize = 500
+	tribes := make(map[int64]int64, len(playerIDs))
+
+	for start := 0; start < len(playerIDs); start += batchSize {
+		end := start + batchSize
+		if end > len(playerIDs) {
+			end = len(playerIDs)
+		}
+
+		pipe := s.db.Pipeline()
+		cmds := make([]*redis.StringCmd, 0, end-start)
+		for _, id := range playerIDs[start:end] {
+			cmds = append(cmds, pipe.HGet(ctx, "playerinfo:"+strconv.FormatInt(id, 10), "TribeID"))
+		}
+		if err := execPipeline(ctx, pipe); err != nil {
+			return nil, err
+		}
+
+		for i, cmd := range cmds {
+			tribeID, err := cmd.Int64()
+			if err == redis.Nil {
+				continue
+			} else if err != nil {
+				log.Error().Err(err).Msg("loading playerinfo TribeID")
+				continue
+			}
+			tribes[playerIDs[start+i]] = tribeID
+		}
+	}
+
+	return tribes, nil
+}
+
+// ErrKeyspaceNotificationsDisabled is returned when the redis server does not
+// publish keyspace notifications for string commands.
+var ErrKeyspaceNotificationsDisabled = errors.New("keyspace notifications are disabled")
+
+// GetAllPlayerID returns every known playerID. The keys are walked with SCAN
+// so the server is not blocked on large clusters.
 func (s *AtlasDB) GetAllPlayerID(ctx context.Context) ([]int64, error) {
 	p := []int64{}
-	r := s.db.Keys(ctx, "PlayerDataId:*")
-	players, err := r.Result()
+	scanner := s.NewPlayerScanner(1000)
+	for {
+		ids, done, err := scanner.Next(ctx)
+		if err != nil {
+			return nil, err
+		}
+		p = append(p, ids...)
+		if done {
+			return p, nil
+		}
+	}
+}
+
+// PlayerScanner incrementally walks the PlayerDataId:* keys with SCAN.
+type PlayerScanner struct {
+	db     *AtlasDB
+	cursor uint64
+	count  int64
+}
+
+// NewPlayerScanner creates a scanner requesting count keys per batch.
+func (s *AtlasDB) NewPlayerScanner(count int64) *PlayerScanner {
+	return &PlayerScanner{db: s, count: count}
+}
+
+// Next returns the playerIDs of the next batch. done is true when the batch
+// completed a full pass of the keyspace, after which the scanner starts over.
+func (p *PlayerScanner) Next(ctx context.Context) (ids []int64, done bool, err error) {
+	keys, cursor, err := scanKeys(ctx, p.db.db, p.cursor, "PlayerDataId:*", p.count)
 	if err != nil {
+		return nil, false, err
+	}
+	p.cursor = cursor
+
+	for _, key := range keys {
+		if id, ok := playerIDFromKey(key); ok {
+			ids = append(ids, id)
+		}
+	}
+	return ids, cursor == 0, nil
+}
+
+// SubNewPlayers returns a channel pumped with playerIDs as their PlayerDataId
+// keys are set. ErrKeyspaceNotificationsDisabled is returned if the server
+// does not have keyspace notifications enabled; they are not enabled here as
+// the redis server belongs to the game. Keyspace notifications are not
+// supported on a redis cluster, where each node only publishes its own keys.
+func (s *AtlasDB) SubNewPlayers(ctx context.Context) (<-chan int64, error) {
+	if _, ok := s.db.(*redis.ClusterClient); ok {
+		return nil, fmt.Errorf("%w: not supported on a redis cluster", ErrKeyspaceNotificationsDisabled)
+	}
+
+	config, err := s.db.ConfigGet(ctx, "notify-keyspace-events").Result()
+	if err != nil {
+		// CONFIG is often renamed or disabled on managed servers
+		return nil, fmt.Errorf("%w: %s", ErrKeyspaceNotificationsDisabled, err)
+	}
+	if len(config) != 2 {
+		return nil, ErrKeyspaceNotificationsDisabled
+	}
+	flags, _ := config[1].(string)
+	if !strings.Contains(flags, "K") || !strings.ContainsAny(flags, "A$") {
+		return nil, ErrKeyspaceNotificationsDisabled
+	}
+
+	prefix := fmt.Sprintf("__keyspace@%d__:", s.dbNumber)
+	sub := s.db.PSubscribe(ctx, prefix+"PlayerDataId:*")
+	if _, err := sub.Receive(ctx); err != nil {
+		sub.Close()
 		return nil, err
 	}
 
-	for _, player := range players {
-		s := strings.Split(player, ":")
-		if len(s) == 2 {
-			id, err := strconv.ParseInt(s[1], 10, 64)
-			if err != nil {
-				log.Error().Err(err).Msgf("processing", player)
-				continue
+	channel := make(chan int64, 100)
+	go func() {
+		defer close(channel)
+		defer sub.Close()
+		messages := sub.Channel()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case msg, ok := <-messages:
+				if !ok {
+					return
+				}
+				if msg.Payload != "set" {
+					continue
+				}
+				if id, ok := playerIDFromKey(strings.TrimPrefix(msg.Channel, prefix)); ok {
+					select {
+					case channel <- id:
+					case <-ctx.Done():
+						return
+					}
+				}
 			}
-			p = append(p, id)
 		}
+	}()
+	return channel, nil
+}
+
+// playerIDFromKey parses the playerID from a PlayerDataId:<id> key.
+func playerIDFromKey(key string) (int64, bool) {
+	s := strings.Split(key, ":")
+	if len(s) != 2 {
+		return 0, false
 	}
-	return p, nil
+	id, err := strconv.ParseInt(s[1], 10, 64)
+	if err != nil {
+		log.Error().Err(err).Msgf("processing %s", key)
+		return 0, false
+	}
+	return id, true
 }
 
 // GetSteamIDFromPlayerID returns the SteamID of a playerID.
@@ -0,0 +1,350 @@
+package atlasdb
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// Tribe permissions granted by rank groups and tribe administration.
+const (
+	PermissionOwner    = "owner"
+	PermissionAdmin    = "admin"
+	PermissionInvite   = "invite"
+	PermissionPromote  = "promote"
+	PermissionDemote   = "demote"
+	PermissionBanish   = "banish"
+	PermissionDemolish = "demolish"
+	PermissionAttach   = "attach"
+	PermissionBuild    = "buildinrange"
+	PermissionUnclaim  = "unclaim"
+)
+
+// TribeRankGroup is a tribe rank group. Players reference their group by its
+// index in the tribe's rank groups with PlayerInfo.RankGroupID.
+type TribeRankGroup struct {
+	RankGroupID                   int
+	RankGroupName                 string
+	RankGroupRank                 int
+	InventoryRank                 int
+	StructureActivationRank       int
+	NewStructureActivationRank    int
+	NewStructureInventoryRank     int
+	PetOrderRank                  int
+	PetRidingRank                 int
+	InviteRank                    int
+	MaxPromotionGroup             int
+	MaxDemotionGroup              int
+	MaxBanishmentGroup            int
+	NumInvitesRemaining           int
+	BPreventStructureDemolish     bool
+	BPreventStructureAttachment   bool
+	BPreventStructureBuildInRange bool
+	BPreventUnclaiming            bool
+	BAllowInvites                 bool
+	BLimitInvites                 bool
+	BAllowDemotions               bool
+	BAllowPromotions              bool
+	BAllowBanishments             bool
+	BDefaultRank                  bool
+
+	// Properties not known to this version
+	Extra map[string]string `json:",omitempty"`
+}
+
+// Permissions lists the tribe actions members of the group may perform.
+func (g *TribeRankGroup) Permissions() []string {
+	p := []string{}
+	if g.BAllowInvites {
+		p = append(p, PermissionInvite)
+	}
+	if g.BAllowPromotions {
+		p = append(p, PermissionPromote)
+	}
+	if g.BAllowDemotions {
+		p = append(p, PermissionDemote)
+	}
+	if g.BAllowBanishments {
+		p = append(p, PermissionBanish)
+	}
+	if !g.BPreventStructureDemolish {
+		p = append(p, PermissionDemolish)
+	}
+	if !g.BPreventStructureAttachment {
+		p = append(p, PermissionAttach)
+	}
+	if !g.BPreventStructureBuildInRange {
+		p = append(p, PermissionBuild)
+	}
+	if !g.BPreventUnclaiming {
+		p = append(p, PermissionUnclaim)
+	}
+	return p
+}
+
+// RankGroups parses the tribe's TribeRankGroups.
+func (t *TribeData) RankGroups() ([]TribeRankGroup, error) {
+	return ParseTribeRankGroups(t.TribeRankGroups)
+}
+
+// MemberPermissions returns the permissions of a tribe member. The owner and
+// tribe administrators hold every permission.
+func (t *TribeData) MemberPermissions(player *PlayerInfo, steamID string, groups []TribeRankGroup) []string {
+	p := []string{}
+	if t.IsOwner(player.PlayerID) {
+		p = append(p, PermissionOwner)
+	}
+	if t.IsAdmin(player.PlayerID, steamID) {
+		return append(p, PermissionAdmin, PermissionInvite, PermissionPromote, PermissionDemote,
+			PermissionBanish, PermissionDemolish, PermissionAttach, PermissionBuild, PermissionUnclaim)
+	}
+	if player.RankGroupID >= 0 && player.RankGroupID < len(groups) {
+		return append(p, groups[player.RankGroupID].Permissions()...)
+	}
+	return p
+}
+
+// ParseTribeRankGroups parses rank groups stored in UE export text, such as
+// ((RankGroupName="Officer",bAllowInvites=True),(RankGroupName="Crew")), or
+// as a JSON array of objects. Unknown properties are kept in Extra.
+func ParseTribeRankGroups(data string) ([]TribeRankGroup, error) {
+	data = strings.TrimSpace(data)
+	if data == "" {
+		return []TribeRankGroup{}, nil
+	}
+
+	var entries []map[string]string
+	var err error
+	if strings.HasPrefix(data, "[") {
+		entries, err = parseJSONRankGroups(data)
+	} else {
+		entries, err = parseExportTextRankGroups(data)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	groups := make([]TribeRankGroup, 0, len(entries))
+	for i, entry := range entries {
+		g := TribeRankGroup{RankGroupID: i}
+		if err := setRankGroupFields(&g, entry); err != nil {
+			return nil, fmt.Errorf("rank group %d: %w", i, err)
+		}
+		groups = append(groups, g)
+	}
+	return groups, nil
+}
+
+func parseJSONRankGroups(data string) ([]map[string]string, error) {
+	raw := []map[string]interface{}{}
+	if err := json.Unmarshal([]byte(data), &raw); err != nil {
+		return nil, err
+	}
+
+	entries := make([]map[string]string, len(raw))
+	for i, r := range raw {
+		entries[i] = make(map[string]string, len(r))
+		for k, v := range r {
+			entries[i][k] = fmt.Sprint(v)
+		}
+	}
+	return entries, nil
+}
+
+func parseExportTextRankGroups(data string) ([]map[string]string, error) {
+	p := &exportTextParser{data: data}
+	v, err := p.parseValue()
+	if err != nil {
+		return nil, err
+	}
+	if p.pos != len(p.data) {
+		return nil, fmt.Errorf("unexpected %q at %d", p.data[p.pos:], p.pos)
+	}
+
+	// A single group is exported without the surrounding array
+	if group, ok := v.(map[string]interface{}); ok {
+		v = []interface{}{group}
+	}
+	list, ok := v.([]interface{})
+	if !ok {
+		return nil, errors.New("rank groups are not a list")
+	}
+
+	entries := make([]map[string]string, 0, len(list))
+	for _, item := range list {
+		group, ok := item.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("rank group is not a struct")
+		}
+		entry := make(map[string]string, len(group))
+		for k, v := range group {
+			entry[k] = fmt.Sprint(v)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// setRankGroupFields assigns the properties to the fields of the same name.
+func setRankGroupFields(g *TribeRankGroup, entry map[string]string) error {
+	rv := reflect.ValueOf(g).Elem()
+	t := rv.Type()
+
+	for name, value := range entry {
+		found := false
+		for i := 0; i < t.NumField(); i++ {
+			f := t.Field(i)
+			if f.Name == "Extra" || f.Name == "RankGroupID" || !strings.EqualFold(f.Name, name) {
+				continue
+			}
+			found = true
+
+			field := rv.Field(i)
+			switch field.Kind() {
+			case reflect.String:
+				field.SetString(value)
+			case reflect.Int:
+				n, err := strconv.Atoi(value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				field.SetInt(int64(n))
+			case reflect.Bool:
+				b, err := strconv.ParseBool(value)
+				if err != nil {
+					return fmt.Errorf("%s: %w", name, err)
+				}
+				field.SetBool(b)
+			}
+			break
+		}
+
+		if !found {
+			if g.Extra == nil {
+				g.Extra = make(map[string]string)
+			}
+			g.Extra[name] = value
+		}
+	}
+	return nil
+}
+
+// exportTextParser parses the UE export text format. Parenthesised lists of
+// Key=Value pairs are returned as maps, other lists as slices and all other
+// values as strings.
+type exportTextParser struct {
+	data string
+	pos  int
+}
+
+func (p *exportTextParser) parseValue() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.data) {
+		return "", nil
+	}
+
+	switch p.data[p.pos] {
+	case '(':
+		return p.parseList()
+	case '"':
+		return p.parseString()
+	}
+
+	start := p.pos
+	for p.pos < len(p.data) && !strings.ContainsRune(",)", rune(p.data[p.pos])) {
+		p.pos++
+	}
+	return strings.TrimSpace(p.data[start:p.pos]), nil
+}
+
+func (p *exportTextParser) parseList() (interface{}, error) {
+	p.pos++ // (
+	p.skipSpace()
+
+	var list []interface{}
+	var fields map[string]interface{}
+	for p.pos < len(p.data) && p.data[p.pos] != ')' {
+		if key, ok := p.peekKey(); ok {
+			if fields == nil {
+				fields = make(map[string]interface{})
+			}
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			fields[key] = value
+		} else {
+			value, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			list = append(list, value)
+		}
+
+		p.skipSpace()
+		if p.pos < len(p.data) && p.data[p.pos] == ',' {
+			p.pos++
+			p.skipSpace()
+		}
+	}
+	if p.pos >= len(p.data) {
+		return nil, errors.New("unterminated list")
+	}
+	p.pos++ // )
+
+	if fields != nil {
+		return fields, nil
+	}
+	if list == nil {
+		list = []interface{}{}
+	}
+	return list, nil
+}
+
+// peekKey consumes an identifier followed by "=" if one is next.
+func (p *exportTextParser) peekKey() (string, bool) {
+	i := p.pos
+	for i < len(p.data) && (isIdentRune(p.data[i])) {
+		i++
+	}
+	if i == p.pos || i >= len(p.data) || p.data[i] != '=' {
+		return "", false
+	}
+	key := p.data[p.pos:i]
+	p.pos = i + 1
+	return key, true
+}
+
+func (p *exportTextParser) parseString() (interface{}, error) {
+	p.pos++ // "
+	sb := strings.Builder{}
+	for p.pos < len(p.data) {
+		c := p.data[p.pos]
+		p.pos++
+		switch c {
+		case '\\':
+			if p.pos < len(p.data) {
+				sb.WriteByte(p.data[p.pos])
+				p.pos++
+			}
+		case '"':
+			return sb.String(), nil
+		default:
+			sb.WriteByte(c)
+		}
+	}
+	return nil, errors.New("unterminated string")
+}
+
+func (p *exportTextParser) skipSpace() {
+	for p.pos < len(p.data) && strings.ContainsRune(" \t\r\n", rune(p.data[p.pos])) {
+		p.pos++
+	}
+}
+
+func isIdentRune(c byte) bool {
+	return c == '_' || c >= '0' && c <= '9' || c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z'
+}
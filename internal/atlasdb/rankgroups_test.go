@@ -0,0 +1,119 @@
+package atlasdb
+
+import (
+	"reflect"
+	"testing"
+)
+
+// exportedRankGroups is TribeRankGroups as saved by an ATLAS server.
+const exportedRankGroups = `((RankGroupName="Admiral",RankGroupRank=0,InventoryRank=0,StructureActivationRank=0,NewStructureActivationRank=0,NewStructureInventoryRank=0,PetOrderRank=0,PetRidingRank=0,InviteRank=0,MaxPromotionGroup=0,MaxDemotionGroup=0,MaxBanishmentGroup=0,NumInvitesRemaining=0,bPreventStructureDemolish=False,bPreventStructureAttachment=False,bPreventStructureBuildInRange=False,bPreventUnclaiming=False,bAllowInvites=True,bLimitInvites=False,bAllowDemotions=True,bAllowPromotions=True,bAllowBanishments=True,bDefaultRank=False),(RankGroupName="Deckhand",RankGroupRank=3,InventoryRank=3,StructureActivationRank=3,NewStructureActivationRank=3,NewStructureInventoryRank=3,PetOrderRank=3,PetRidingRank=3,InviteRank=3,MaxPromotionGroup=0,MaxDemotionGroup=0,MaxBanishmentGroup=0,NumInvitesRemaining=2,bPreventStructureDemolish=True,bPreventStructureAttachment=False,bPreventStructureBuildInRange=False,bPreventUnclaiming=True,bAllowInvites=True,bLimitInvites=True,bAllowDemotions=False,bAllowPromotions=False,bAllowBanishments=False,bDefaultRank=True))`
+
+func TestParseTribeRankGroups(t *testing.T) {
+	admiral := TribeRankGroup{
+		RankGroupName:     "Admiral",
+		BAllowInvites:     true,
+		BAllowDemotions:   true,
+		BAllowPromotions:  true,
+		BAllowBanishments: true,
+	}
+	deckhand := TribeRankGroup{
+		RankGroupID:                1,
+		RankGroupName:              "Deckhand",
+		RankGroupRank:              3,
+		InventoryRank:              3,
+		StructureActivationRank:    3,
+		NewStructureActivationRank: 3,
+		NewStructureInventoryRank:  3,
+		PetOrderRank:               3,
+		PetRidingRank:              3,
+		InviteRank:                 3,
+		NumInvitesRemaining:        2,
+		BPreventStructureDemolish:  true,
+		BPreventUnclaiming:         true,
+		BAllowInvites:              true,
+		BLimitInvites:              true,
+		BDefaultRank:               true,
+	}
+
+	tests := []struct {
+		name    string
+		data    string
+		want    []TribeRankGroup
+		wantErr bool
+	}{
+		{name: "empty", data: "", want: []TribeRankGroup{}},
+		{name: "whitespace", data: " \n", want: []TribeRankGroup{}},
+		{name: "export text", data: exportedRankGroups, want: []TribeRankGroup{admiral, deckhand}},
+		{name: "single group", data: `(RankGroupName="Crew",bAllowInvites=True)`, want: []TribeRankGroup{{RankGroupName: "Crew", BAllowInvites: true}}},
+		{name: "empty list", data: "()", want: []TribeRankGroup{}},
+		{
+			name: "quoted separators",
+			data: `((RankGroupName="Captain, \"Jack\" (ret.)"))`,
+			want: []TribeRankGroup{{RankGroupName: `Captain, "Jack" (ret.)`}},
+		},
+		{
+			name: "unknown properties",
+			data: `((RankGroupName="Crew",bCanUseCannons=True,Flags=(1,2)))`,
+			want: []TribeRankGroup{{RankGroupName: "Crew", Extra: map[string]string{"bCanUseCannons": "True", "Flags": "[1 2]"}}},
+		},
+		{
+			name: "json",
+			data: `[{"RankGroupName":"Admiral","bAllowInvites":true,"NumInvitesRemaining":5},{"RankGroupName":"Crew"}]`,
+			want: []TribeRankGroup{
+				{RankGroupName: "Admiral", BAllowInvites: true, NumInvitesRemaining: 5},
+				{RankGroupID: 1, RankGroupName: "Crew"},
+			},
+		},
+		{name: "unterminated list", data: `((RankGroupName="Crew"`, wantErr: true},
+		{name: "unterminated string", data: `((RankGroupName="Crew))`, wantErr: true},
+		{name: "trailing data", data: `((RankGroupName="Crew")) junk`, wantErr: true},
+		{name: "not a list", data: `Crew`, wantErr: true},
+		{name: "not a struct", data: `(1,2)`, wantErr: true},
+		{name: "bad bool", data: `((RankGroupName="Crew",bAllowInvites=Maybe))`, wantErr: true},
+		{name: "bad int", data: `((RankGroupName="Crew",InviteRank=high))`, wantErr: true},
+		{name: "bad json", data: `[{"RankGroupName":}]`, wantErr: true},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got, err := ParseTribeRankGroups(test.data)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("error = %v, want error %v", err, test.wantErr)
+			}
+			if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %+v\nwant %+v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestMemberPermissions(t *testing.T) {
+	groups, err := ParseTribeRankGroups(exportedRankGroups)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tribe := &TribeData{TribeOwnerPlayerDataID: 1, TribeAdmins: "(2,76561197960287930)"}
+
+	tests := []struct {
+		name    string
+		player  PlayerInfo
+		steamID string
+		want    []string
+	}{
+		{"owner", PlayerInfo{PlayerID: 1}, "", []string{PermissionOwner, PermissionAdmin, PermissionInvite, PermissionPromote, PermissionDemote, PermissionBanish, PermissionDemolish, PermissionAttach, PermissionBuild, PermissionUnclaim}},
+		{"admin by playerID", PlayerInfo{PlayerID: 2, RankGroupID: 1}, "", []string{PermissionAdmin, PermissionInvite, PermissionPromote, PermissionDemote, PermissionBanish, PermissionDemolish, PermissionAttach, PermissionBuild, PermissionUnclaim}},
+		{"admin by steamID", PlayerInfo{PlayerID: 3, RankGroupID: 1}, "76561197960287930", []string{PermissionAdmin, PermissionInvite, PermissionPromote, PermissionDemote, PermissionBanish, PermissionDemolish, PermissionAttach, PermissionBuild, PermissionUnclaim}},
+		{"admiral", PlayerInfo{PlayerID: 4}, "", []string{PermissionInvite, PermissionPromote, PermissionDemote, PermissionBanish, PermissionDemolish, PermissionAttach, PermissionBuild, PermissionUnclaim}},
+		{"deckhand", PlayerInfo{PlayerID: 5, RankGroupID: 1}, "", []string{PermissionInvite, PermissionAttach, PermissionBuild}},
+		{"unknown rank group", PlayerInfo{PlayerID: 6, RankGroupID: 7}, "", []string{}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			got := tribe.MemberPermissions(&test.player, test.steamID, groups)
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package atlasdb
+
+import (
+	"context"
+	"errors"
+	"sort"
+	"sync"
+
+	"github.com/go-redis/redis/v8"
+)
+
+// clusterCursorBits is the width of the node cursor in the cursor of a cluster
+// scan. The bits above it select the master being scanned.
+const clusterCursorBits = 48
+
+// scanKeys runs SCAN on the client. A cluster's masters are scanned one after
+// another, in address order, so the cursor carries the index of the master
+// along with its cursor. Masters added or removed between calls may cause
+// keys to be skipped or repeated.
+func scanKeys(ctx context.Context, client redis.UniversalClient, cursor uint64, match string, count int64) ([]string, uint64, error) {
+	cluster, ok := client.(*redis.ClusterClient)
+	if !ok {
+		return client.Scan(ctx, cursor, match, count).Result()
+	}
+
+	masters, err := clusterMasters(ctx, cluster)
+	if err != nil {
+		return nil, cursor, err
+	}
+	node, nodeCursor := int(cursor>>clusterCursorBits), cursor&(1<<clusterCursorBits-1)
+	if node >= len(masters) {
+		return nil, 0, nil
+	}
+
+	keys, next, err := masters[node].Scan(ctx, nodeCursor, match, count).Result()
+	if err != nil {
+		return nil, cursor, err
+	}
+	if next >= 1<<clusterCursorBits {
+		return nil, cursor, errors.New("redis cluster cursor out of range")
+	}
+	if next == 0 {
+		if node++; node == len(masters) {
+			return keys, 0, nil
+		}
+	}
+	return keys, uint64(node)<<clusterCursorBits | next, nil
+}
+
+// clusterMasters returns the masters of the cluster ordered by address.
+func clusterMasters(ctx context.Context, cluster *redis.ClusterClient) ([]*redis.Client, error) {
+	var (
+		mu      sync.Mutex
+		masters []*redis.Client
+	)
+	err := cluster.ForEachMaster(ctx, func(ctx context.Context, master *redis.Client) error {
+		mu.Lock()
+		masters = append(masters, master)
+		mu.Unlock()
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(masters, func(i, j int) bool {
+		return masters[i].Options().Addr < masters[j].Options().Addr
+	})
+	return masters, nil
+}
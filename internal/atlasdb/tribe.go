@@ -2,15 +2,15 @@ package atlasdb
 
 import (
 	"context"
-	"encoding/hex"
-	"encoding/json"
-	"fmt"
+	"errors"
+	"net"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/antihax/AtlasMap/internal/atlasdata"
 	"github.com/go-redis/redis/v8"
-	"github.com/lunixbochs/struc"
+	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 )
 
@@ -38,39 +38,105 @@ type TribeData struct {
 // GetPlayerSteamID returns the SteamID of a playerID.
 func (s *AtlasDB) GetTribeByID(ctx context.Context, tribeID int64) (*TribeData, error) {
 	p := &TribeData{}
-	if err := s.db.HGetAll(ctx, "tribedata:"+strconv.FormatInt(tribeID, 10)).Scan(p); err != nil {
+	if err := s.tribe.HGetAll(ctx, "tribedata:"+strconv.FormatInt(tribeID, 10)).Scan(p); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
+// AdminIDs returns the IDs listed in TribeAdmins. ATLAS stores the list as a
+// bracketed, separated string such as "(1234,5678)".
+func (t *TribeData) AdminIDs() []string {
+	return strings.FieldsFunc(strings.Trim(t.TribeAdmins, "()[]"), func(r rune) bool {
+		return r == ',' || r == ' '
+	})
+}
+
+// IsAdmin determines if the player is a tribe administrator. The owner is
+// always an administrator.
+func (t *TribeData) IsAdmin(playerID int64, steamID string) bool {
+	if t.IsOwner(playerID) {
+		return true
+	}
+	id := strconv.FormatInt(playerID, 10)
+	for _, admin := range t.AdminIDs() {
+		if admin == id || admin == steamID {
+			return true
+		}
+	}
+	return false
+}
+
+// IsOwner determines if the player owns the tribe.
+func (t *TribeData) IsOwner(playerID int64) bool {
+	return t.TribeOwnerPlayerDataID != 0 && t.TribeOwnerPlayerDataID == playerID
+}
+
 // GetTribeEntityIDList returns the tribe entitiy ID list.
 func (s *AtlasDB) GetTribeEntityIDList(ctx context.Context, tribeID int64) ([]int64, error) {
 	p := []int64{}
-	if err := s.db.SMembers(ctx, "tribedata.entities:"+strconv.FormatInt(tribeID, 10)).ScanSlice(&p); err != nil {
+	if err := s.tribe.SMembers(ctx, "tribedata.entities:"+strconv.FormatInt(tribeID, 10)).ScanSlice(&p); err != nil {
 		return nil, err
 	}
 	return p, nil
 }
 
-// GetTribeEntities returns the tribe entitiy ID list.
-func (s *AtlasDB) GetTribeEntities(ctx context.Context, tribeID int64) ([]TribeEntityUpdate, error) {
+// TribeSnapshot ends the entity updates sent for a snapshot of the tribe.
+// Skipped counts the entities that were missing or could not be read.
+type TribeSnapshot struct {
+	Entities int
+	Skipped  int
+}
+
+// GetTribeEntities returns the entities of the tribe, fetched in pipelined
+// batches. Entities that are missing or fail to load are skipped and counted
+// rather than failing the snapshot.
+func (s *AtlasDB) GetTribeEntities(ctx context.Context, tribeID int64) ([]TribeEntityUpdate, int, error) {
+	const batchSize = 500
 	list := []TribeEntityUpdate{}
+	skipped := 0
+
 	ids, err := s.GetTribeEntityIDList(ctx, tribeID)
 	if err != nil {
-		return nil, err
+		return nil, 0, err
 	}
 
-	for _, id := range ids {
-		p := TribeEntityUpdate{}
-		err := s.db.HGetAll(ctx, "entityinfo:"+strconv.FormatInt(id, 10)).Scan(&p)
-		if err != nil {
-			return nil, err
+	for start := 0; start < len(ids); start += batchSize {
+		end := start + batchSize
+		if end > len(ids) {
+			end = len(ids)
+		}
+
+		pipe := s.tribe.Pipeline()
+		cmds := make([]*redis.StringStringMapCmd, 0, end-start)
+		for _, id := range ids[start:end] {
+			cmds = append(cmds, pipe.HGetAll(ctx, "entityinfo:"+strconv.FormatInt(id, 10)))
+		}
+		if err := execPipeline(ctx, pipe); err != nil {
+			return nil, 0, err
+		}
+
+		for i, cmd := range cmds {
+			if err := cmd.Err(); err != nil {
+				log.Debug().Err(err).Msgf("loading entityinfo:%d", ids[start+i])
+				skipped++
+				continue
+			}
+			if len(cmd.Val()) == 0 {
+				skipped++
+				continue
+			}
+			p := TribeEntityUpdate{}
+			if err := cmd.Scan(&p); err != nil {
+				log.Debug().Err(err).Msgf("scanning entityinfo:%d", ids[start+i])
+				skipped++
+				continue
+			}
+			list = append(list, p)
 		}
-		list = append(list, p)
 	}
 
-	return list, nil
+	return list, skipped, nil
 }
 
 type TribeEntityUpdate struct {
@@ -85,99 +151,198 @@ type TribeEntityUpdate struct {
 	IsDead         bool    `redis:"bIsDead"`
 }
 
-// SubTribe returns a channel pumped with UE event data from the tribe.
-func (s *AtlasDB) SubTribe(ctx context.Context, tribeID int64) <-chan string {
-	sub := s.db.Subscribe(ctx, "tribemsg:"+strconv.FormatInt(tribeID, 10))
-	channel := make(chan string, 40)
-	go s.processTribeChannel(ctx, channel, sub)
-	return channel
+// TribeChat is a chat message sent to the tribe.
+type TribeChat struct {
+	SenderName      string
+	SenderSteamName string
+	SenderTribeName string
+	SenderID        uint32
+	Message         string
+	SendMode        string
+	IsTribeOwner    bool
 }
 
-func (s *AtlasDB) processTribeMessage(msg string, channel chan string, CRC int32) error {
+// chatCRC identifies the tribe chat notification.
+const chatCRC = 156265321
 
-	// 1652749511 Tribe Log
-	// 1466483860 remove entity
+// PublishTribeChat sends a chat message to the tribe in the same notification
+// the servers publish, so it reaches players in game as well as subscribers.
+func (s *AtlasDB) PublishTribeChat(ctx context.Context, tribeID int64, chat TribeChat) error {
+	msg, err := atlasdata.PackMessage(atlasdata.BubbleWrap{CRC: chatCRC}, &atlasdata.Chat{
+		SenderName:      atlasdata.NewFString(chat.SenderName),
+		SenderSteamName: atlasdata.NewFString(chat.SenderSteamName),
+		SenderTribeName: atlasdata.NewFString(chat.SenderTribeName),
+		SenderID:        chat.SenderID,
+		Message:         atlasdata.NewFString(chat.Message),
+		SendMode:        atlasdata.NewFString(chat.SendMode),
+		UserID:          atlasdata.NewFString(""),
+		BIsTribeOwner:   chat.IsTribeOwner,
+	})
+	if err != nil {
+		return err
+	}
+	return s.tribe.Publish(ctx, "tribemsg:"+strconv.FormatInt(tribeID, 10), msg).Err()
+}
 
-	switch CRC {
-	case -1646244981: // MemberPresenceUpdated
-		{
-			b := &atlasdata.MemberPresenceUpdated{}
-			err := struc.Unpack(strings.NewReader(msg), b)
-			if err != nil {
-				log.Err(err).Msg("Unpack")
-				return err
+// TribeMemberPresence is sent when a tribe member's presence changes. Whether
+// the member came online or went offline is not known from the notification,
+// LastOnlineAt is passed on as sent by the server.
+type TribeMemberPresence struct {
+	PlayerID     uint32
+	LastOnlineAt int32
+}
+
+// RawTribeMessage is an undecoded BubbleWrap framed message from a tribe
+// channel.
+type RawTribeMessage struct {
+	Time    time.Time
+	Channel string
+	Payload []byte
+}
+
+// Backoff between attempts to restore the tribe subscription.
+const (
+	minResubscribeBackoff = 500 * time.Millisecond
+	maxResubscribeBackoff = 30 * time.Second
+)
+
+// subscriptionHealthCheck is how long a subscription may be idle before it is
+// pinged. A ping left unanswered as long again fails the subscription.
+const subscriptionHealthCheck = 30 * time.Second
+
+// SubRawTribeMessages returns a channel pumped with the raw messages of every
+// tribe. A lost subscription is restored in the background with exponential
+// backoff. The channel is closed when the context is canceled.
+func (s *AtlasDB) SubRawTribeMessages(ctx context.Context) <-chan RawTribeMessage {
+	channel := make(chan RawTribeMessage, 100)
+	go func() {
+		defer close(channel)
+		backoff := minResubscribeBackoff
+		for {
+			err := s.pumpRawTribeMessages(ctx, channel, func() { backoff = minResubscribeBackoff })
+			if ctx.Err() != nil {
+				return
+			}
+
+			log.Warn().Err(err).Msgf("tribe subscription lost, resubscribing in %s", backoff)
+			select {
+			case <-time.After(backoff):
+			case <-ctx.Done():
+				return
+			}
+			if backoff *= 2; backoff > maxResubscribeBackoff {
+				backoff = maxResubscribeBackoff
 			}
 		}
-	case 156265321:
-		{
-			b := &atlasdata.Chat{}
-			err := struc.Unpack(strings.NewReader(msg), b)
-			if err != nil {
-				log.Err(err).Msg("Unpack")
+	}()
+	return channel
+}
+
+// pumpRawTribeMessages subscribes to every tribe and pumps the messages until
+// the subscription fails or the context is canceled. subscribed is called once
+// the subscription is confirmed.
+func (s *AtlasDB) pumpRawTribeMessages(ctx context.Context, channel chan<- RawTribeMessage, subscribed func()) error {
+	sub := s.tribe.PSubscribe(ctx, "tribemsg:*")
+	defer sub.Close()
+
+	// go-redis doesn't support cancellations, closing unblocks the receive
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			sub.Close()
+		case <-done:
+		}
+	}()
+
+	pinged := false
+	for {
+		msg, err := sub.ReceiveTimeout(ctx, subscriptionHealthCheck)
+		if err != nil {
+			var netErr net.Error
+			if !errors.As(err, &netErr) || !netErr.Timeout() || pinged {
 				return err
 			}
-		}
-	case 834710557:
-		{
-			// [TODO] find a better way to remove trailing null byte
-			b := &atlasdata.AddRemoveEntity{}
-			err := struc.Unpack(strings.NewReader(msg), b)
-			if err != nil {
-				log.Err(err).Msg("Unpack")
+			if err := sub.Ping(ctx); err != nil {
 				return err
 			}
+			pinged = true
+			continue
+		}
+		pinged = false
 
-			// Hack to deal with inconsistent shiptypes
-			b.TribeEntity.ShipType.Value.String = strings.Replace(b.TribeEntity.ShipType.Value.String, "EShipType::", "", 1)
-			b.TribeEntity.EntityType.Value.String = strings.Replace(b.TribeEntity.ShipType.Value.String, "ETribeEntityType::", "", 1)
-
-			v, err := json.Marshal(TribeEntityUpdate{
-				EntityID:       b.TribeEntity.EntityID.Value,
-				ParentEntityID: b.TribeEntity.ParentEntityID.Value,
-				EntityType:     strings.TrimRight(b.TribeEntity.EntityType.Value.String, "\u0000"),
-				ShipType:       strings.TrimRight(b.TribeEntity.ShipType.Value.String, "\u0000"),
-				EntityName:     strings.TrimRight(b.TribeEntity.EntityName.Value.String, "\u0000"),
-				ServerID:       b.TribeEntity.ServerID.Value,
-				X:              b.TribeEntity.ServerRelativeLocationInCurrentServerMap.Value.X,
-				Y:              b.TribeEntity.ServerRelativeLocationInCurrentServerMap.Value.Y,
-				IsDead:         b.TribeEntity.BIsDead.Value,
-			})
-
-			if err != nil {
-				log.Err(err).Msg("Marshal")
-				return err
+		switch msg := msg.(type) {
+		case *redis.Subscription:
+			subscribed()
+		case *redis.Message:
+			select {
+			case channel <- RawTribeMessage{
+				Time:    time.Now().UTC(),
+				Channel: msg.Channel,
+				Payload: []byte(msg.Payload),
+			}:
+			case <-ctx.Done():
+				return ctx.Err()
 			}
-			channel <- string(v)
 		}
-	default:
-		log.Info().Msgf("unknown crc %d", CRC)
-		fmt.Println(hex.Dump([]byte(msg)))
 	}
-	return nil
 }
 
-func (s *AtlasDB) processTribeChannel(ctx context.Context, channel chan string, sub *redis.PubSub) {
-	for {
-		select {
-		case <-ctx.Done():
-			close(channel)
-			return
-		default:
-			// go-redis doesn't support cancellations 🙃🙃🙃
-			// [TODO] Trace and add cancellation support
-			msg, err := sub.ReceiveMessage(ctx)
+// trimFString removes the trailing null bytes UE leaves on strings.
+func trimFString(f atlasdata.FString) string {
+	return strings.TrimRight(f.String, "\u0000")
+}
+
+// unknownMessageLog limits the logging of unknown messages, which may arrive
+// for every action in game.
+var unknownMessageLog = log.Sample(&zerolog.BurstSampler{Burst: 10, Period: time.Minute})
+
+// decodeTribeMessage decodes a raw tribe message. Unknown messages are logged
+// at debug level, use tribecapture to record them, and return a nil event.
+func (s *AtlasDB) decodeTribeMessage(msg RawTribeMessage) (*TribeEvent, error) {
+	e, header, err := s.messages.DecodeTribeMessage(msg)
+	if errors.Is(err, ErrUnknownMessage) {
+		unknownMessageLog.Debug().
+			Int32("crc", header.CRC).
+			Str("channel", msg.Channel).
+			Hex("payload", msg.Payload[bubbleWrapSize:]).
+			Msg("unknown tribe message")
+		return nil, nil
+	}
+	return e, err
+}
+
+// TribeEvent is an event for a tribe.
+type TribeEvent struct {
+	TribeID int64
+	Event   Event
+}
+
+// SubAllTribes returns a channel pumped with the events of every tribe from a
+// single pattern subscription. The channel is closed when the context is
+// canceled.
+func (s *AtlasDB) SubAllTribes(ctx context.Context) <-chan TribeEvent {
+	raw := s.SubRawTribeMessages(ctx)
+	channel := make(chan TribeEvent, 100)
+	go func() {
+		defer close(channel)
+		for msg := range raw {
+			e, err := s.decodeTribeMessage(msg)
 			if err != nil {
-				log.Err(err).Msg("SubTribe")
+				log.Err(err).Msg("decodeTribeMessage")
+				continue
 			}
-
-			// Unpack header from the message
-			bubbleWrap := &atlasdata.BubbleWrap{}
-			if err := struc.Unpack(strings.NewReader(msg.Payload[:12]), bubbleWrap); err != nil {
-				log.Err(err).Msg("Unpack")
+			if e == nil {
+				continue
 			}
-			if err := s.processTribeMessage(msg.Payload[12:], channel, bubbleWrap.CRC); err != nil {
-				log.Err(err).Msg("processTribeMessage")
+
+			select {
+			case channel <- *e:
+			case <-ctx.Done():
+				return
 			}
 		}
-	}
+	}()
+	return channel
 }
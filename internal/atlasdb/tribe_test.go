@@ -0,0 +1,45 @@
+package atlasdb
+
+import (
+	"context"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// newTestDB creates an AtlasDB backed by miniredis.
+func newTestDB(t *testing.T) (*AtlasDB, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	db, err := NewAtlasDB(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, mr
+}
+
+func TestGetTribeEntities(t *testing.T) {
+	db, mr := newTestDB(t)
+	mr.SAdd("tribedata.entities:100", "1", "2", "3", "4", "5")
+	mr.HSet("entityinfo:1", "EntityID", "1", "EntityType", "Ship", "ServerId", "65537")
+	mr.Set("entityinfo:2", "WRONGTYPE")
+	mr.HSet("entityinfo:4", "EntityID", "not a number")
+	mr.HSet("entityinfo:5", "EntityID", "5", "EntityType", "Bed")
+
+	entities, skipped, err := db.GetTribeEntities(context.Background(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if skipped != 3 {
+		t.Errorf("skipped = %d, want the wrong type, missing and corrupt entities", skipped)
+	}
+	if len(entities) != 2 {
+		t.Fatalf("got %d entities, want 2", len(entities))
+	}
+	for _, e := range entities {
+		if e.EntityID != 1 && e.EntityID != 5 {
+			t.Errorf("unexpected entity %+v", e)
+		}
+	}
+}
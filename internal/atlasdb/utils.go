@@ -24,3 +24,9 @@ func ServerID(packed string) (split [2]uint16, err error) {
 	split[1] = binary.LittleEndian.Uint16(buf[2:])
 	return
 }
+
+// PackServerID packs the X and Y server coordinates into a server ID. It is
+// the inverse of ServerID.
+func PackServerID(x, y uint16) uint32 {
+	return uint32(x) | uint32(y)<<16
+}
@@ -1,51 +1,290 @@
 package atlasmapserver
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math"
+	"mime"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
 	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
 )
 
+// maxCommandLength limits the size of a command sent to the servers.
+const maxCommandLength = 512
+
 func (s *AtlasMapServer) apiRouter(r *mux.Route) {
-	//	router := r.Subrouter()
+	router := r.Subrouter()
+	router.Use(s.sessionMiddleware)
+	router.Use(s.requireRole(RoleServerAdmin))
+	router.HandleFunc("/command", s.commandHandler).Methods(http.MethodPost)
+	router.HandleFunc("/broker", s.brokerStatsHandler).Methods(http.MethodGet)
+	router.HandleFunc("/events", s.adminEventHandler).Methods(http.MethodGet)
+	router.HandleFunc("/entities", s.entitiesHandler).Methods(http.MethodGet)
+}
+
+// adminEventHandler streams the events of every tribe passing the filter in
+// the query. Each event carries its TribeID.
+func (s *AtlasMapServer) adminEventHandler(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "Streaming unsupported!", http.StatusInternalServerError)
+		return
+	}
+
+	filter, err := parseEventFilter(r.URL.Query())
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
+	principal := r.Context().Value(PrincipalKey).(*Principal)
+	log.Info().
+		Str("audit", "events").
+		Str("steamID", principal.SteamID).
+		Str("remoteAddr", r.RemoteAddr).
+		Str("filter", r.URL.RawQuery).
+		Msg("watching events")
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	sub := s.broker.AddWatcher(filter)
+	defer s.broker.RemoveSubscriber(sub)
+	flusher.Flush()
+
+	s.streamEvents(w, r, flusher, sub)
 }
 
-/*
-// sendCommand publishes an event to the GeneralNotifications:GlobalCommands
-// redis PubSub channel. To send a server command, prepend "ID::X,Y::" where
-// ID is the packed server ID; X and Y are the relative lng and lat locations.
-func (s *AtlasMapServer) sendCommand(w http.ResponseWriter, r *http.Request) {
-	w.Header().Set("Access-Control-Allow-Origin", "*")
+// parseEventFilter reads the filter from the repeatable tribe, server,
+// entityType and kind query parameters. Servers are given by grid as "X,Y".
+func parseEventFilter(q url.Values) (eventbroker.Filter, error) {
+	filter := eventbroker.Filter{}
+	var err error
+	if filter.TribeIDs, err = parseTribeIDs(q["tribe"]); err != nil {
+		return filter, err
+	}
+	if filter.ServerIDs, err = parseServerIDs(q["server"]); err != nil {
+		return filter, err
+	}
+	filter.EntityTypes = append(filter.EntityTypes, q["entityType"]...)
+	for _, v := range q["kind"] {
+		filter.Kinds = append(filter.Kinds, atlasdb.EventKind(v))
+	}
+	return filter, nil
+}
+
+func parseTribeIDs(values []string) ([]int64, error) {
+	var ids []int64
+	for _, v := range values {
+		tribeID, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("invalid tribe %q", v)
+		}
+		ids = append(ids, tribeID)
+	}
+	return ids, nil
+}
 
-	if r.Method != "POST" || s.config.DisableCommands {
-		w.WriteHeader(http.StatusMethodNotAllowed)
+// parseServerIDs packs servers given by grid as "X,Y".
+func parseServerIDs(values []string) ([]uint32, error) {
+	var ids []uint32
+	for _, v := range values {
+		var x, y uint16
+		if _, err := fmt.Sscanf(v, "%d,%d", &x, &y); err != nil {
+			return nil, fmt.Errorf("invalid server %q", v)
+		}
+		ids = append(ids, atlasdb.PackServerID(x, y))
+	}
+	return ids, nil
+}
+
+// maxEntityPage limits the count of an entities request.
+const maxEntityPage = 1000
+
+type entityPage struct {
+	Entities []atlasdb.EntityInfo
+
+	// Cursor continues the listing, "0" once complete
+	Cursor string
+}
+
+// entitiesHandler lists the entities of every tribe one page at a time. The
+// query takes the cursor of the previous page, a count hint and the
+// repeatable entityType, shipType, server and tribe filters.
+func (s *AtlasMapServer) entitiesHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+
+	q := r.URL.Query()
+	cursor, err := strconv.ParseUint(getQuery(q, "cursor", "0"), 10, 64)
+	if err != nil {
+		http.Error(w, "invalid cursor", http.StatusBadRequest)
+		return
+	}
+	count, err := strconv.ParseInt(getQuery(q, "count", "100"), 10, 64)
+	if err != nil || count < 1 || count > maxEntityPage {
+		http.Error(w, fmt.Sprintf("count must be between 1 and %d", maxEntityPage), http.StatusBadRequest)
 		return
 	}
 
-	body, err := ioutil.ReadAll(r.Body)
+	query := atlasdb.EntityQuery{
+		EntityTypes: q["entityType"],
+		ShipTypes:   q["shipType"],
+	}
+	if query.TribeIDs, err = parseTribeIDs(q["tribe"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if query.ServerIDs, err = parseServerIDs(q["server"]); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	page := entityPage{}
+	page.Entities, cursor, err = s.db.ScanEntities(r.Context(), cursor, count, query)
 	if err != nil {
-		log.Println(err)
+		dbError(w, err, "db.ScanEntities")
+		return
 	}
+	page.Cursor = strconv.FormatUint(cursor, 10)
 
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(page)
 	if err != nil {
-		w.WriteHeader(http.StatusBadRequest)
+		log.Error().Err(err).Msg("entitiesHandler json encode")
 		return
 	}
+}
+
+func getQuery(q url.Values, key, fallback string) string {
+	if v := q.Get(key); v != "" {
+		return v
+	}
+	return fallback
+}
+
+// brokerStatsHandler reports the events not delivered to connections that
+// fell behind.
+func (s *AtlasMapServer) brokerStatsHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+
+	w.WriteHeader(http.StatusOK)
+	err := json.NewEncoder(w).Encode(s.broker.Stats())
+	if err != nil {
+		log.Error().Err(err).Msg("brokerStatsHandler json encode")
+		return
+	}
+}
+
+// commandRequest is a command to broadcast to all servers, or to the server
+// at ServerID when set. X and Y are the relative lng and lat locations on the
+// target server.
+type commandRequest struct {
+	Command  string
+	ServerID *[2]uint16
+	X        float64
+	Y        float64
+}
+
+// encode validates the request and returns the command as published. Server
+// commands are prepended with "ID::X,Y::" where ID is the packed server ID.
+func (c *commandRequest) encode() (string, error) {
+	command := strings.TrimSpace(c.Command)
+	if command == "" {
+		return "", errors.New("command is required")
+	}
+	if len(command) > maxCommandLength {
+		return "", fmt.Errorf("command exceeds %d bytes", maxCommandLength)
+	}
+	if strings.Contains(command, "::") {
+		return "", errors.New("command must not contain \"::\"")
+	}
+	for _, r := range command {
+		if unicode.IsControl(r) {
+			return "", errors.New("command must not contain control characters")
+		}
+	}
+
+	if c.ServerID == nil {
+		return command, nil
+	}
+
+	for _, v := range []float64{c.X, c.Y} {
+		if math.IsNaN(v) || math.IsInf(v, 0) {
+			return "", errors.New("location must be a finite number")
+		}
+	}
+	id := atlasdb.PackServerID(c.ServerID[0], c.ServerID[1])
+	return fmt.Sprintf("%d::%g,%g::%s", id, c.X, c.Y, command), nil
+}
+
+// commandHandler publishes a command to the GeneralNotifications:GlobalCommands
+// redis PubSub channel and records who sent it in the audit log.
+func (s *AtlasMapServer) commandHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+
+	if s.config.DisableCommands {
+		http.Error(w, "Commands are disabled", http.StatusForbidden)
+		return
+	}
+
+	// Requiring JSON forces a CORS preflight for cross site requests
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/json" {
+		http.Error(w, "Content-Type must be application/json", http.StatusUnsupportedMediaType)
+		return
+	}
+
+	principal := r.Context().Value(PrincipalKey).(*Principal)
 
-	if len(body) == 0 {
-		w.WriteHeader(http.StatusOK)
+	req := commandRequest{}
+	dec := json.NewDecoder(http.MaxBytesReader(w, r.Body, 4096))
+	dec.DisallowUnknownFields()
+	if err := dec.Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 
-	encoded := fmt.Sprintf("%s", body)
+	command, err := req.encode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
 
-	log.Println("publish:", encoded)
-	result, err := s.redisClient.Publish("GeneralNotifications:GlobalCommands", encoded).Result()
+	receivers, err := s.db.PublishCommand(r.Context(), command)
+	audit := log.Info().
+		Str("audit", "command").
+		Str("steamID", principal.SteamID).
+		Int64("playerID", principal.PlayerID).
+		Str("remoteAddr", r.RemoteAddr).
+		Str("command", command).
+		Int64("receivers", receivers)
 	if err != nil {
-		log.Println("redis error for: ", encoded, "; ", err)
-		w.WriteHeader(http.StatusInternalServerError)
+		audit.Err(err).Msg("command failed")
+		if atlasdb.IsUnavailable(err) {
+			http.Error(w, "Atlas database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
 		return
 	}
+	audit.Msg("command sent")
 
-	w.Write([]byte(strconv.FormatInt(result, 10)))
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(struct{ Receivers int64 }{receivers})
+	if err != nil {
+		log.Error().Err(err).Msg("commandHandler json encode")
+		return
+	}
 }
-*/
@@ -3,12 +3,17 @@ package atlasmapserver
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/fs"
 	"net/http"
-	"sync"
 
 	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/redisstore"
 	"github.com/gorilla/mux"
+	"github.com/gorilla/securecookie"
 	"github.com/gorilla/sessions"
 	"github.com/rs/zerolog/log"
 )
@@ -18,6 +23,8 @@ func (s *AtlasMapServer) sessionRouter(r *mux.Route) {
 	router.Use(s.sessionMiddleware)
 	router.HandleFunc("/account", s.accountHandler)
 	router.HandleFunc("/events", s.eventHandler)
+	router.HandleFunc("/ws", s.webSocketHandler)
+	s.tribeRouter(router.PathPrefix("/tribe"))
 }
 
 // sessionMiddleware adds session data to the context
@@ -25,8 +32,14 @@ func (s *AtlasMapServer) sessionMiddleware(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		session, err := s.store.Get(r, "session")
 		if err != nil {
-			log.Error().Err(err).Msg("bad session")
-			http.SetCookie(w, &http.Cookie{Name: "session", MaxAge: -1, Path: "/"})
+			if !invalidSession(err) {
+				log.Error().Err(err).Msg("session store")
+				http.Error(w, "Session store unavailable", http.StatusServiceUnavailable)
+				return
+			}
+			log.Info().Err(err).Msg("bad session")
+			s.clearSessionCookie(w)
+			http.Error(w, "Not authenticated", http.StatusUnauthorized)
 			return
 		}
 
@@ -46,7 +59,19 @@ func (s *AtlasMapServer) sessionMiddleware(next http.Handler) http.Handler {
 	})
 }
 
+// invalidSession determines if the session failed to load because the cookie
+// or the stored session is invalid, rather than the store being unavailable.
+func invalidSession(err error) bool {
+	var cookieErr securecookie.Error
+	if errors.As(err, &cookieErr) && cookieErr.IsDecode() {
+		return true
+	}
+	// Filesystem sessions removed on logout or expiry
+	return errors.Is(err, fs.ErrNotExist) || errors.Is(err, redisstore.ErrInvalidSession)
+}
+
 type accountData struct {
+	Role         Role
 	Tribe        *atlasdb.TribeData
 	Player       *atlasdb.PlayerInfo
 	PlayerServer *atlasdb.PlayerServerInfo
@@ -63,26 +88,30 @@ func (s *AtlasMapServer) accountHandler(w http.ResponseWriter, r *http.Request)
 
 	accData := accountData{}
 
+	principal, err := s.getPrincipal(r)
+	if err != nil {
+		dbError(w, err, "getPrincipal")
+		return
+	}
+	accData.Role = principal.Role
+
 	playerID := session.Values["playerID"].(int64)
 	accData.PlayerServer, err = s.db.GetPlayerServerInfoFromSteamID(r.Context(), steamID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Error().Err(err).Msg("db.GetPlayerServerInfoFromSteamID")
+		dbError(w, err, "db.GetPlayerServerInfoFromSteamID")
 		return
 	}
 
 	accData.Player, err = s.db.GetPlayerInfoFromPlayerID(r.Context(), playerID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Error().Err(err).Msg("db.GetPlayerInfoFromPlayerID")
+		dbError(w, err, "db.GetPlayerInfoFromPlayerID")
 		return
 	}
 
 	if accData.Player.TribeID > 0 {
 		accData.Tribe, err = s.db.GetTribeByID(r.Context(), accData.Player.TribeID)
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Error().Err(err).Msg("db.GetTribeByID")
+			dbError(w, err, "db.GetTribeByID")
 			return
 		}
 	}
@@ -118,53 +147,88 @@ func (s *AtlasMapServer) eventHandler(w http.ResponseWriter, r *http.Request) {
 
 	playerInfo, err := s.db.GetPlayerInfoFromPlayerID(r.Context(), playerID)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Error().Err(err).Msg("db.GetPlayerInfoFromPlayerID")
+		dbError(w, err, "db.GetPlayerInfoFromPlayerID")
 		return
 	}
 
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
-	channel := s.broker.AddUser(steamID, playerInfo.TribeID)
-	defer s.broker.RemoveChannel(channel)
-
-	// send initial entries
-	entities, err := s.db.GetTribeEntities(r.Context(), playerInfo.TribeID)
-	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		log.Error().Err(err).Msg("db.GetTribeEntities")
-		return
-	}
+	// reconnecting browsers resume from the last event they received
+	sub, resumed := s.broker.AddUser(steamID, playerInfo.TribeID, r.Header.Get("Last-Event-ID"))
+	defer s.broker.RemoveSubscriber(sub)
 
-	wg := &sync.WaitGroup{}
-	wg.Add(1)
-	go func(wg *sync.WaitGroup) {
-		defer wg.Done()
-		// stream the rest
-		for {
-			select {
-			case msg := <-channel:
-				fmt.Fprintf(w, "data: %s\n\n", msg)
-				flusher.Flush()
-			case <-r.Context().Done():
-				log.Debug().Msgf("eventHandler %s", r.Context().Err())
-				flusher.Flush()
+	// send initial entries, events arriving meanwhile are buffered
+	if !resumed {
+		events, err := s.tribeSnapshot(r.Context(), playerInfo.TribeID)
+		if err != nil {
+			dbError(w, err, "db.GetTribeEntities")
+			return
+		}
+		for _, e := range events {
+			if err := writeEvent(w, e); err != nil {
+				log.Error().Err(err).Msg("writeEvent")
 				return
 			}
 		}
-	}(wg)
+	}
+	flusher.Flush()
 
-	for _, entity := range entities {
-		v, err := json.Marshal(entity)
+	s.streamEvents(w, r, flusher, sub)
+}
+
+// streamEvents writes the events of the subscriber to the SSE stream until the
+// request ends or the subscriber is closed.
+func (s *AtlasMapServer) streamEvents(w http.ResponseWriter, r *http.Request, flusher http.Flusher, sub *eventbroker.Subscriber) {
+	for {
+		msg, err := sub.Next(r.Context())
 		if err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			log.Error().Err(err).Msg("unmarshaling entities")
+			log.Debug().Msgf("streamEvents %s", err)
+			flusher.Flush()
 			return
 		}
+		if err := writeEvent(w, msg); err != nil {
+			log.Error().Err(err).Msg("writeEvent")
+			return
+		}
+		flusher.Flush()
+	}
+}
+
+// tribeSnapshot returns an update for each entity of the tribe followed by a
+// snapshot event counting them.
+func (s *AtlasMapServer) tribeSnapshot(ctx context.Context, tribeID int64) ([]atlasdb.Event, error) {
+	entities, skipped, err := s.db.GetTribeEntities(ctx, tribeID)
+	if err != nil {
+		return nil, err
+	}
+	if skipped > 0 {
+		log.Warn().Int64("tribeID", tribeID).Int("skipped", skipped).Msg("skipped missing or corrupt entities")
+	}
 
-		channel <- string(v)
+	events := make([]atlasdb.Event, 0, len(entities)+1)
+	for _, entity := range entities {
+		events = append(events, atlasdb.NewEvent(atlasdb.EventEntityUpdate, entity.ServerID, entity))
+	}
+	events = append(events, atlasdb.NewEvent(atlasdb.EventSnapshot, 0, atlasdb.TribeSnapshot{Entities: len(entities), Skipped: skipped}))
+	for i := range events {
+		events[i].TribeID = tribeID
 	}
+	return events, nil
+}
 
-	wg.Wait()
+// writeEvent writes the event to the stream in SSE format, naming the event
+// after its kind. Events with an ID can be resumed with Last-Event-ID.
+func writeEvent(w io.Writer, e atlasdb.Event) error {
+	v, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	if e.ID != "" {
+		if _, err := fmt.Fprintf(w, "id: %s\n", e.ID); err != nil {
+			return err
+		}
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Kind, v)
+	return err
 }
@@ -0,0 +1,44 @@
+package atlasmapserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/redisstore"
+	"github.com/go-redis/redis/v8"
+)
+
+func TestSessionMiddlewareErrors(t *testing.T) {
+	s, mr := newTestServer(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr(), MaxRetries: -1})
+	t.Cleanup(func() { client.Close() })
+	s.store = redisstore.NewRedisStore(client, []byte("0123456789abcdef0123456789abcdef"))
+
+	handler := s.sessionMiddleware(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	serve := func(cookie *http.Cookie) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/s/account", nil)
+		r.AddCookie(cookie)
+		w := httptest.NewRecorder()
+		handler.ServeHTTP(w, r)
+		return w
+	}
+
+	w := serve(&http.Cookie{Name: "session", Value: "forged"})
+	if w.Code != http.StatusUnauthorized {
+		t.Errorf("forged cookie status = %d, want 401", w.Code)
+	}
+	if c := w.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("forged cookie not cleared: %v", c)
+	}
+
+	valid := sessionCookie(t, s, "76561197960287930", 1, nil)
+	mr.Close()
+	w = serve(valid)
+	if w.Code != http.StatusServiceUnavailable {
+		t.Errorf("redis down status = %d, want 503", w.Code)
+	}
+	if c := w.Result().Cookies(); len(c) != 0 {
+		t.Errorf("cookie cleared while redis is down: %v", c)
+	}
+}
@@ -0,0 +1,193 @@
+package atlasmapserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/gorilla/mux"
+	"github.com/rs/zerolog/log"
+)
+
+// tribeRouter provides the routes scoped to the caller's tribe.
+func (s *AtlasMapServer) tribeRouter(r *mux.Route) {
+	router := r.Subrouter()
+	router.Use(s.requireRole(RoleTribeMember))
+	router.HandleFunc("/members", s.tribeMembersHandler)
+	router.Handle("/ranks", s.requirePermission(atlasdb.PermissionPromote, atlasdb.PermissionDemote)(http.HandlerFunc(s.tribeRanksHandler)))
+}
+
+type tribeMember struct {
+	PlayerID        int64
+	PlayerName      string
+	RankGroupID     int
+	RankGroupName   string
+	Role            Role
+	CurrentServerID *[2]uint16
+
+	// LastOnlineAt is the latest of the playerinfo and presence events
+	LastOnlineAt int64
+
+	// Online is read from the latest presence event seen for the member, or
+	// from the playerinfo when none has been seen. Servers clear LastOnlineAt
+	// while a member is online.
+	Online bool
+
+	// PresenceLive is true when Online comes from a presence event
+	PresenceLive bool
+}
+
+// tribeMembersHandler lists the members of the caller's tribe with their
+// current server and presence.
+func (s *AtlasMapServer) tribeMembersHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+
+	principal := r.Context().Value(PrincipalKey).(*Principal)
+	if principal.TribeID == 0 {
+		http.Error(w, "Not in a tribe", http.StatusNotFound)
+		return
+	}
+
+	tribe, err := s.db.GetTribeByID(r.Context(), principal.TribeID)
+	if err != nil {
+		dbError(w, err, "db.GetTribeByID")
+		return
+	}
+
+	// Rank names are informational, don't fail the roster on bad rank data
+	rankGroups, err := tribe.RankGroups()
+	if err != nil {
+		log.Error().Err(err).Msg("tribe.RankGroups")
+	}
+
+	members, err := s.tribeMembers(r.Context(), principal.TribeID)
+	if err != nil {
+		dbError(w, err, "tribeMembers")
+		return
+	}
+
+	steamIDs := make([]string, 0, len(members))
+	for _, member := range members {
+		if steamID, err := s.GetSteamIDFromPlayerID(member.PlayerID); err == nil {
+			steamIDs = append(steamIDs, steamID)
+		}
+	}
+	serverInfos, err := s.db.GetPlayerServerInfos(r.Context(), steamIDs)
+	if err != nil {
+		dbError(w, err, "db.GetPlayerServerInfos")
+		return
+	}
+
+	roster := []tribeMember{}
+	for _, member := range members {
+		steamID, _ := s.GetSteamIDFromPlayerID(member.PlayerID)
+		m := tribeMember{
+			PlayerID:     member.PlayerID,
+			PlayerName:   member.PlayerName,
+			RankGroupID:  member.RankGroupID,
+			Role:         tribeRole(tribe, member.PlayerID, steamID),
+			LastOnlineAt: member.LastOnlineAt,
+			Online:       member.LastOnlineAt <= 0,
+		}
+		if member.RankGroupID >= 0 && member.RankGroupID < len(rankGroups) {
+			m.RankGroupName = rankGroups[member.RankGroupID].RankGroupName
+		}
+
+		if info, ok := serverInfos[steamID]; ok {
+			serverID, err := atlasdb.ServerID(strconv.FormatInt(info.CurrentServerID, 10))
+			if err == nil {
+				m.CurrentServerID = &serverID
+			}
+		}
+
+		if presence, ok := s.broker.MemberPresence(member.PlayerID); ok {
+			m.Online = presence.LastOnlineAt <= 0
+			m.PresenceLive = true
+			if int64(presence.LastOnlineAt) > m.LastOnlineAt {
+				m.LastOnlineAt = int64(presence.LastOnlineAt)
+			}
+		}
+
+		roster = append(roster, m)
+	}
+
+	// output json struct
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(roster)
+	if err != nil {
+		log.Error().Err(err).Msg("tribeMembersHandler json encode")
+		return
+	}
+}
+
+type tribeMemberRank struct {
+	PlayerID      int64
+	PlayerName    string
+	RankGroupID   int
+	RankGroupName string
+	Role          Role
+	Permissions   []string
+}
+
+type tribeRanksData struct {
+	RankGroups []atlasdb.TribeRankGroup
+	Members    []tribeMemberRank
+}
+
+// tribeRanksHandler lists the tribe rank groups and the rank and permissions
+// of each member.
+func (s *AtlasMapServer) tribeRanksHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache, no-store, must-revalidate, max-age=0")
+
+	principal := r.Context().Value(PrincipalKey).(*Principal)
+	if principal.TribeID == 0 {
+		http.Error(w, "Not in a tribe", http.StatusNotFound)
+		return
+	}
+
+	tribe, err := s.db.GetTribeByID(r.Context(), principal.TribeID)
+	if err != nil {
+		dbError(w, err, "db.GetTribeByID")
+		return
+	}
+
+	data := tribeRanksData{Members: []tribeMemberRank{}}
+	data.RankGroups, err = tribe.RankGroups()
+	if err != nil {
+		log.Error().Err(err).Int64("tribeID", principal.TribeID).Msg("tribe.RankGroups")
+		http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+		return
+	}
+
+	members, err := s.tribeMembers(r.Context(), principal.TribeID)
+	if err != nil {
+		dbError(w, err, "tribeMembers")
+		return
+	}
+
+	for _, member := range members {
+		steamID, _ := s.GetSteamIDFromPlayerID(member.PlayerID)
+		m := tribeMemberRank{
+			PlayerID:    member.PlayerID,
+			PlayerName:  member.PlayerName,
+			RankGroupID: member.RankGroupID,
+			Role:        tribeRole(tribe, member.PlayerID, steamID),
+			Permissions: tribe.MemberPermissions(member, steamID, data.RankGroups),
+		}
+		if member.RankGroupID >= 0 && member.RankGroupID < len(data.RankGroups) {
+			m.RankGroupName = data.RankGroups[member.RankGroupID].RankGroupName
+		}
+		data.Members = append(data.Members, m)
+	}
+
+	// output json struct
+	w.WriteHeader(http.StatusOK)
+	err = json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Error().Err(err).Msg("tribeRanksHandler json encode")
+		return
+	}
+}
@@ -0,0 +1,79 @@
+package atlasmapserver
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
+	"github.com/gorilla/mux"
+)
+
+func TestTribeMembersPresence(t *testing.T) {
+	s, mr := newTestServer(t)
+	ctx := context.Background()
+	s.broker = eventbroker.NewEventBroker(s.db, eventbroker.Options{BufferSize: 4})
+	t.Cleanup(s.broker.Close)
+
+	mr.HSet("tribedata:100", "TribeID", "100", "TribeName", "Pirates", "TribeOwnerPlayerDataID", "1")
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100", "PlayerName", "Jack", "LastOnlineAt", "1600000000")
+	mr.HSet("playerinfo:2", "PlayerId", "2", "TribeID", "100", "PlayerName", "Gibbs", "LastOnlineAt", "1600000000")
+	mr.HSet("playerinfo:3", "PlayerId", "3", "TribeID", "100", "PlayerName", "Cotton")
+	for id, steamID := range map[string]string{"1": "76561197960287931", "2": "76561197960287932", "3": "76561197960287933"} {
+		mr.Set("PlayerDataId:"+id, steamID)
+	}
+	for id := int64(1); id <= 3; id++ {
+		s.addPlayer(ctx, id)
+	}
+	s.indexPlayers(ctx, []int64{1, 2, 3})
+
+	s.broker.SendTribe(100, atlasdb.Event{
+		Kind:    atlasdb.EventMemberPresence,
+		Payload: atlasdb.TribeMemberPresence{PlayerID: 1, LastOnlineAt: 0},
+	})
+	s.broker.SendTribe(100, atlasdb.Event{
+		Kind:    atlasdb.EventMemberPresence,
+		Payload: atlasdb.TribeMemberPresence{PlayerID: 2, LastOnlineAt: 1600000100},
+	})
+
+	router := mux.NewRouter()
+	router.Use(s.sessionMiddleware)
+	s.tribeRouter(router.PathPrefix("/tribe"))
+
+	r := httptest.NewRequest(http.MethodGet, "/tribe/members", nil)
+	r.AddCookie(sessionCookie(t, s, "76561197960287931", 1, nil))
+	w := httptest.NewRecorder()
+	router.ServeHTTP(w, r)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status = %d, want 200", w.Code)
+	}
+
+	type presence struct {
+		PlayerID     int64
+		LastOnlineAt int64
+		Online       bool
+		PresenceLive bool
+	}
+	var roster []presence
+	if err := json.NewDecoder(w.Body).Decode(&roster); err != nil {
+		t.Fatal(err)
+	}
+	want := map[int64]presence{
+		1: {Online: true, PresenceLive: true, LastOnlineAt: 1600000000},
+		2: {Online: false, PresenceLive: true, LastOnlineAt: 1600000100},
+		3: {Online: true, PresenceLive: false, LastOnlineAt: 0},
+	}
+	if len(roster) != len(want) {
+		t.Fatalf("got %d members, want %d", len(roster), len(want))
+	}
+	for _, m := range roster {
+		expect := want[m.PlayerID]
+		if m.Online != expect.Online || m.PresenceLive != expect.PresenceLive || m.LastOnlineAt != expect.LastOnlineAt {
+			t.Errorf("player %d: Online %v PresenceLive %v LastOnlineAt %d, want %v %v %d",
+				m.PlayerID, m.Online, m.PresenceLive, m.LastOnlineAt, expect.Online, expect.PresenceLive, expect.LastOnlineAt)
+		}
+	}
+}
@@ -0,0 +1,355 @@
+package atlasmapserver
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
+	"github.com/gorilla/websocket"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	wsWriteWait      = 10 * time.Second
+	wsPongWait       = 60 * time.Second
+	wsPingPeriod     = wsPongWait * 9 / 10
+	wsMaxMessageSize = 4096
+
+	// maxChatLength limits the size of a chat message sent to the tribe.
+	maxChatLength = 512
+
+	// A user may send chatBurst chat messages at once over all of their
+	// connections, refilled at one message per chatInterval.
+	chatBurst    = 5
+	chatInterval = 2 * time.Second
+)
+
+// eventError reports a failed client request over the WebSocket.
+const eventError atlasdb.EventKind = "error"
+
+// wsRequest is a message from a WebSocket client.
+//
+//	{"Type": "chat", "Message": "Ahoy"}
+//	{"Type": "subscribe", "Scope": "tribe:123", "LastEventID": "..."}
+//	{"Type": "unsubscribe", "Scope": "tribe:123"}
+//	{"Type": "snapshot", "Scope": "tribe:123"}
+//
+// An empty Scope is the caller's tribe.
+type wsRequest struct {
+	Type        string
+	Message     string
+	Scope       string
+	LastEventID string
+}
+
+// wsError is the payload of an error event.
+type wsError struct {
+	Type  string
+	Error string
+}
+
+// wsConn serializes writes to the connection.
+type wsConn struct {
+	conn *websocket.Conn
+	mu   sync.Mutex
+}
+
+func (c *wsConn) writeEvent(e atlasdb.Event) error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.conn.SetWriteDeadline(time.Now().Add(wsWriteWait))
+	return c.conn.WriteJSON(e)
+}
+
+func (c *wsConn) close(code int, reason string) {
+	c.conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(code, reason), time.Now().Add(wsWriteWait))
+}
+
+// wsSession is the state of a WebSocket client.
+type wsSession struct {
+	principal *Principal
+	player    *atlasdb.PlayerInfo
+	tribe     *atlasdb.TribeData
+	conn      *wsConn
+	sub       *eventbroker.Subscriber
+}
+
+// webSocketHandler streams the same events as eventHandler over a WebSocket
+// and accepts requests from the client. Reconnecting clients pass the ID of
+// the last event received as the lastEventId query parameter.
+func (s *AtlasMapServer) webSocketHandler(w http.ResponseWriter, r *http.Request) {
+	principal, err := s.getPrincipal(r)
+	if err != nil {
+		dbError(w, err, "getPrincipal")
+		return
+	}
+
+	session := &wsSession{principal: principal}
+	session.player, err = s.db.GetPlayerInfoFromPlayerID(r.Context(), principal.PlayerID)
+	if err != nil {
+		dbError(w, err, "db.GetPlayerInfoFromPlayerID")
+		return
+	}
+	if principal.TribeID > 0 {
+		session.tribe, err = s.db.GetTribeByID(r.Context(), principal.TribeID)
+		if err != nil {
+			dbError(w, err, "db.GetTribeByID")
+			return
+		}
+	}
+
+	// CORS does not apply to WebSockets, only accept our own origin
+	upgrader := websocket.Upgrader{
+		CheckOrigin: func(r *http.Request) bool {
+			return r.Header.Get("Origin") == s.config.OriginAllowed
+		},
+	}
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		log.Debug().Err(err).Msg("websocket upgrade")
+		return
+	}
+	session.conn = &wsConn{conn: conn}
+
+	var resumed bool
+	session.sub, resumed = s.broker.AddUser(principal.SteamID, principal.TribeID, r.URL.Query().Get("lastEventId"))
+
+	ctx, cancel := context.WithCancel(r.Context())
+	wg := &sync.WaitGroup{}
+	defer func() {
+		cancel()
+		conn.Close()
+		// The reader may still subscribe, wait before removing the subscriber
+		wg.Wait()
+		s.broker.RemoveSubscriber(session.sub)
+	}()
+
+	if !resumed {
+		if err := s.wsSnapshot(ctx, session, principal.TribeID); err != nil {
+			log.Error().Err(err).Msg("wsSnapshot")
+			return
+		}
+	}
+
+	wg.Add(2)
+	go s.wsRead(ctx, cancel, wg, session)
+	go wsPing(ctx, cancel, wg, session.conn)
+
+	// stream the events
+	for {
+		msg, err := session.sub.Next(ctx)
+		switch {
+		case errors.Is(err, eventbroker.ErrSlowConsumer):
+			session.conn.close(websocket.CloseTryAgainLater, err.Error())
+			return
+		case err != nil:
+			log.Debug().Msgf("webSocketHandler %s", err)
+			session.conn.close(websocket.CloseGoingAway, "")
+			return
+		}
+		if err := session.conn.writeEvent(msg); err != nil {
+			log.Debug().Err(err).Msg("websocket write")
+			return
+		}
+	}
+}
+
+// wsRead handles the requests of the client until the connection fails.
+func (s *AtlasMapServer) wsRead(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, session *wsSession) {
+	defer wg.Done()
+	defer cancel()
+
+	conn := session.conn.conn
+	conn.SetReadLimit(wsMaxMessageSize)
+	conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(wsPongWait))
+	})
+
+	for {
+		req := wsRequest{}
+		if err := conn.ReadJSON(&req); err != nil {
+			if websocket.IsUnexpectedCloseError(err, websocket.CloseGoingAway, websocket.CloseNormalClosure) {
+				log.Debug().Err(err).Msg("websocket read")
+			}
+			return
+		}
+
+		if err := s.wsHandleRequest(ctx, session, req); err != nil {
+			e := atlasdb.NewEvent(eventError, 0, wsError{Type: req.Type, Error: err.Error()})
+			if err := session.conn.writeEvent(e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// wsPing keeps the connection alive and detects dead clients.
+func wsPing(ctx context.Context, cancel context.CancelFunc, wg *sync.WaitGroup, conn *wsConn) {
+	defer wg.Done()
+	defer cancel()
+
+	ticker := time.NewTicker(wsPingPeriod)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			if err := conn.conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(wsWriteWait)); err != nil {
+				return
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// wsHandleRequest performs a client request.
+func (s *AtlasMapServer) wsHandleRequest(ctx context.Context, session *wsSession, req wsRequest) error {
+	switch req.Type {
+	case "chat":
+		return s.wsChat(ctx, session, req.Message)
+	case "subscribe":
+		tribeID, err := session.scope(req.Scope)
+		if err != nil {
+			return err
+		}
+		if !s.broker.Subscribe(session.sub, tribeID, req.LastEventID) {
+			return s.wsSnapshot(ctx, session, tribeID)
+		}
+		return nil
+	case "unsubscribe":
+		tribeID, err := session.scope(req.Scope)
+		if err != nil {
+			return err
+		}
+		s.broker.Unsubscribe(session.sub, tribeID)
+		return nil
+	case "snapshot":
+		tribeID, err := session.scope(req.Scope)
+		if err != nil {
+			return err
+		}
+		return s.wsSnapshot(ctx, session, tribeID)
+	}
+	return fmt.Errorf("unknown request type %q", req.Type)
+}
+
+// scope returns the tribe of a "tribe:<id>" scope. Only server administrators
+// may follow tribes other than their own.
+func (session *wsSession) scope(scope string) (int64, error) {
+	tribeID := session.principal.TribeID
+	if scope != "" {
+		if !strings.HasPrefix(scope, "tribe:") {
+			return 0, fmt.Errorf("unknown scope %q", scope)
+		}
+		var err error
+		if tribeID, err = strconv.ParseInt(strings.TrimPrefix(scope, "tribe:"), 10, 64); err != nil {
+			return 0, fmt.Errorf("invalid scope %q", scope)
+		}
+	}
+
+	if tribeID == 0 {
+		return 0, errors.New("not in a tribe")
+	}
+	if tribeID != session.principal.TribeID && !session.principal.HasRole(RoleServerAdmin) {
+		return 0, errors.New("access denied")
+	}
+	return tribeID, nil
+}
+
+// wsSnapshot queues the current entities of the tribe. Live events of the
+// tribe are held meanwhile so older entities never overwrite newer updates.
+func (s *AtlasMapServer) wsSnapshot(ctx context.Context, session *wsSession, tribeID int64) error {
+	session.sub.Hold(tribeID)
+	events, err := s.tribeSnapshot(ctx, tribeID)
+	session.sub.Release(tribeID, events)
+	return err
+}
+
+// chatBucket is the chat rate limit of a user.
+type chatBucket struct {
+	tokens float64
+	last   time.Time
+}
+
+// chatLimiter holds the chat rate limits of users, shared by all of their
+// connections so opening more connections does not raise the limit.
+type chatLimiter struct {
+	mu      sync.Mutex
+	buckets map[string]*chatBucket
+}
+
+func newChatLimiter() *chatLimiter {
+	return &chatLimiter{buckets: make(map[string]*chatBucket)}
+}
+
+// allow takes a token from the user's chat rate limit. Buckets idle long
+// enough to refill are dropped when a new one is added, as a new bucket
+// starts full.
+func (l *chatLimiter) allow(steamID string, now time.Time) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	b, ok := l.buckets[steamID]
+	if !ok {
+		for id, old := range l.buckets {
+			if now.Sub(old.last) >= chatBurst*chatInterval {
+				delete(l.buckets, id)
+			}
+		}
+		b = &chatBucket{tokens: chatBurst, last: now}
+		l.buckets[steamID] = b
+	}
+
+	b.tokens += float64(now.Sub(b.last)) / float64(chatInterval)
+	if b.tokens > chatBurst {
+		b.tokens = chatBurst
+	}
+	b.last = now
+	if b.tokens < 1 {
+		return false
+	}
+	b.tokens--
+	return true
+}
+
+// wsChat sends a chat message to the caller's tribe. The message reaches the
+// client back through the tribe's events.
+func (s *AtlasMapServer) wsChat(ctx context.Context, session *wsSession, message string) error {
+	if session.tribe == nil {
+		return errors.New("not in a tribe")
+	}
+
+	message = strings.TrimSpace(message)
+	if message == "" {
+		return errors.New("message is required")
+	}
+	if len(message) > maxChatLength {
+		return fmt.Errorf("message exceeds %d bytes", maxChatLength)
+	}
+	for _, r := range message {
+		if unicode.IsControl(r) {
+			return errors.New("message must not contain control characters")
+		}
+	}
+	if !s.chat.allow(session.principal.SteamID, time.Now()) {
+		return errors.New("sending messages too fast")
+	}
+
+	return s.db.PublishTribeChat(ctx, session.tribe.TribeID, atlasdb.TribeChat{
+		SenderName:      session.player.PlayerName,
+		SenderTribeName: session.tribe.TribeName,
+		SenderID:        uint32(session.player.PlayerID),
+		Message:         message,
+		SendMode:        "TribeChat",
+		IsTribeOwner:    session.tribe.IsOwner(session.player.PlayerID),
+	})
+}
@@ -0,0 +1,103 @@
+package atlasmapserver
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/websocket"
+)
+
+func TestAllowChat(t *testing.T) {
+	l := newChatLimiter()
+	now := time.Now()
+
+	for i := 0; i < chatBurst; i++ {
+		if !l.allow("76561197960287930", now) {
+			t.Fatalf("message %d of the burst refused", i+1)
+		}
+	}
+	if l.allow("76561197960287930", now) {
+		t.Error("message over the burst allowed")
+	}
+	if !l.allow("76561197960287931", now) {
+		t.Error("another user is limited")
+	}
+
+	now = now.Add(chatInterval)
+	if !l.allow("76561197960287930", now) {
+		t.Error("message refused after the refill")
+	}
+	if l.allow("76561197960287930", now) {
+		t.Error("refill allowed more than one message")
+	}
+
+	// Buckets that have refilled are dropped
+	now = now.Add(chatBurst * chatInterval)
+	l.allow("76561197960287932", now)
+	if len(l.buckets) != 1 {
+		t.Errorf("%d buckets kept, want 1", len(l.buckets))
+	}
+}
+
+func TestChatLimitSharedByConnections(t *testing.T) {
+	s, mr := newTestServer(t)
+	s.config.OriginAllowed = "http://localhost"
+	s.broker = eventbroker.NewEventBroker(s.db, eventbroker.Options{BufferSize: 64})
+	t.Cleanup(s.broker.Close)
+
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100", "PlayerName", "Jack")
+	mr.HSet("tribedata:100", "TribeID", "100", "TribeName", "Pirates", "TribeOwnerPlayerDataID", "1")
+
+	router := mux.NewRouter()
+	s.sessionRouter(router.PathPrefix("/s/"))
+	server := httptest.NewServer(router)
+	t.Cleanup(server.Close)
+
+	header := http.Header{}
+	header.Set("Origin", s.config.OriginAllowed)
+	header.Set("Cookie", sessionCookie(t, s, "76561197960287930", 1, nil).String())
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/s/ws"
+
+	conns := make([]*websocket.Conn, 2)
+	for i := range conns {
+		conn, _, err := websocket.DefaultDialer.Dial(url, header)
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { conn.Close() })
+		conns[i] = conn
+	}
+
+	// Together the connections send one message over the burst
+	for i := 0; i <= chatBurst; i++ {
+		if err := conns[i%2].WriteJSON(wsRequest{Type: "chat", Message: "Ahoy"}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	refused := 0
+	for _, conn := range conns {
+		conn.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		for {
+			var e struct {
+				Kind    string
+				Payload json.RawMessage
+			}
+			if err := conn.ReadJSON(&e); err != nil {
+				break
+			}
+			if e.Kind == string(eventError) {
+				refused++
+			}
+		}
+	}
+	if refused != 1 {
+		t.Errorf("%d messages refused, want 1", refused)
+	}
+}
@@ -4,16 +4,18 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"os"
 
 	"github.com/rs/zerolog/log"
 
 	"github.com/antihax/AtlasMap/internal/atlasdb"
 	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/redisstore"
+	"github.com/go-redis/redis/v8"
 	"github.com/gorilla/handlers"
 	"github.com/gorilla/mux"
 	"github.com/gorilla/sessions"
 
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
@@ -27,23 +29,51 @@ type AtlasMapServer struct {
 	mapSteamIDPlayerID sync.Map
 	mapPlayerIDSteamID sync.Map
 
+	// Tribe members found by fetch and the member lists loaded from them
+	tribes  *tribeIndex
+	members *memberCache
+
+	// Chat rate limits of each user, shared by their WebSocket connections
+	chat *chatLimiter
+
 	broker *eventbroker.EventBroker
 
 	config *Configuration
 	router *mux.Router
 	db     *atlasdb.AtlasDB
 
+	// Tribe notification decoders, including those added with RegisterMessage
+	messages *atlasdb.MessageRegistry
+
 	// Session store and CSRF protection
-	store *sessions.FilesystemStore
+	store        sessions.Store
+	sessionRedis redis.UniversalClient
+
+	// Coordinates the event brokers of multiple instances
+	brokerRedis redis.UniversalClient
 
 	//
 	staticProxy *httputil.ReverseProxy
+
+	// Shutdown handling. Run holds mu while setting up, so Shutdown sees
+	// either nothing or everything started.
+	mu           sync.Mutex
+	shuttingDown bool
+	server       *http.Server
+	cancel       context.CancelFunc
+	fetchDone    chan struct{}
+	shutdownOnce sync.Once
+	shutdownErr  error
 }
 
 // NewAtlasMapServer creates a new server
 func NewAtlasMapServer() *AtlasMapServer {
 	return &AtlasMapServer{
-		router: mux.NewRouter(),
+		router:   mux.NewRouter(),
+		tribes:   newTribeIndex(),
+		members:  newMemberCache(),
+		chat:     newChatLimiter(),
+		messages: atlasdb.NewMessageRegistry(),
 	}
 }
 
@@ -69,6 +99,17 @@ type ServerLocation struct {
 	ServerYRelativeLocation float64
 }
 
+// dbError logs a failed database call and answers 503 while the Atlas redis
+// is unavailable, or 500 otherwise, without exposing the redis error.
+func dbError(w http.ResponseWriter, err error, msg string) {
+	log.Error().Err(err).Msg(msg)
+	if atlasdb.IsUnavailable(err) {
+		http.Error(w, "Atlas database unavailable", http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, http.StatusText(http.StatusInternalServerError), http.StatusInternalServerError)
+}
+
 func (s *AtlasMapServer) runStaticProxy(targetHost string) error {
 	url, err := url.Parse(targetHost)
 	if err != nil {
@@ -82,31 +123,126 @@ func (s *AtlasMapServer) runStaticProxy(targetHost string) error {
 	return nil
 }
 
-// Run starts the server processing
-func (s *AtlasMapServer) Run() error {
+// setupSessionStore creates the configured session store. The redis store uses
+// its own redis server, separate from the Atlas redis.
+func (s *AtlasMapServer) setupSessionStore() error {
+	switch s.config.SessionStoreType {
+	case "redis":
+		conn, err := s.config.SessionRedis.connection()
+		if err != nil {
+			return err
+		}
+		if s.sessionRedis, err = atlasdb.NewClient(conn); err != nil {
+			return fmt.Errorf("session redis: %w", err)
+		}
+		store := redisstore.NewRedisStore(s.sessionRedis, []byte(s.config.SessionKey))
+		store.MaxAge(s.config.SessionMaxAge)
+		s.store = store
+	default:
+		store := sessions.NewFilesystemStore(s.config.SessionStore, []byte(s.config.SessionKey))
+		store.MaxAge(s.config.SessionMaxAge)
+		s.store = store
+	}
+	return nil
+}
+
+// setupBroker creates the configured event broker. The redis broker shares
+// events between instances through its own redis server.
+func (s *AtlasMapServer) setupBroker() error {
+	opts := eventbroker.Options{
+		BufferSize:   s.config.BrokerBufferSize,
+		Policy:       s.config.BrokerPolicy,
+		ReplaySize:   s.config.BrokerReplaySize,
+		ReplayWindow: time.Duration(s.config.BrokerReplayWindowInSeconds) * time.Second,
+	}
+
+	switch s.config.BrokerMode {
+	case "redis":
+		conn, err := s.config.BrokerRedis.connection()
+		if err != nil {
+			return err
+		}
+		if s.brokerRedis, err = atlasdb.NewClient(conn); err != nil {
+			return fmt.Errorf("broker redis: %w", err)
+		}
+		s.broker = eventbroker.NewDistributedEventBroker(s.db, s.brokerRedis, opts)
+	default:
+		s.broker = eventbroker.NewEventBroker(s.db, opts)
+	}
+	return nil
+}
+
+// Run starts the server processing and blocks until the context is canceled
+// or Shutdown is called, at which point the server is shut down gracefully.
+// Anything already set up is released when the server fails to start. Run
+// returns immediately when Shutdown was called first.
+func (s *AtlasMapServer) Run(ctx context.Context) (err error) {
+	s.mu.Lock()
+	locked := true
+	unlock := func() {
+		if locked {
+			locked = false
+			s.mu.Unlock()
+		}
+	}
+	defer unlock()
+	if s.shuttingDown {
+		return nil
+	}
+
 	// Load configuration from environment
 	if err := s.loadConfig(); err != nil {
 		return err
 	}
 
+	corsOriginAllowed := s.config.OriginAllowed
+	if len(corsOriginAllowed) == 0 {
+		return errors.New("cors ORIGIN_ALLOWED not set")
+	}
+	if corsOriginAllowed == "*" {
+		return errors.New("gracefully refusing to allow all origins")
+	}
+
+	if s.config.StaticProxy != "" {
+		if err := s.runStaticProxy(s.config.StaticProxy); err != nil {
+			return err
+		}
+	}
+
+	defer func() {
+		if err != nil {
+			unlock()
+			s.Shutdown(context.Background())
+		}
+	}()
+
 	// Setup session store
-	s.store = sessions.NewFilesystemStore(s.config.SessionStore, []byte(s.config.SessionKey))
-	s.store.MaxAge(2400)
+	if err := s.setupSessionStore(); err != nil {
+		return err
+	}
+
 	// Setup our DB pool
-	db, err := atlasdb.NewAtlasDB(
-		s.config.AtlasRedisAddress,
-		s.config.AtlasRedisPassword,
-		s.config.AtlasRedisDB,
-	)
+	opts, err := s.config.atlasDBOptions()
+	if err != nil {
+		return err
+	}
+	opts.Messages = s.messages
+	db, err := atlasdb.NewAtlasDBWithOptions(opts)
 	if err != nil {
 		return err
 	}
 	s.db = db
 
-	s.broker = eventbroker.NewEventBroker(db)
+	if err := s.setupBroker(); err != nil {
+		return err
+	}
+
+	// Cancelled on shutdown to stop the poller and end streaming requests
+	ctx, s.cancel = context.WithCancel(ctx)
 
 	// Poll the database for data
-	go s.fetch()
+	s.fetchDone = make(chan struct{})
+	go s.fetch(ctx)
 
 	// API Endpoints
 	s.apiRouter(s.router.PathPrefix("/api/"))
@@ -117,13 +253,8 @@ func (s *AtlasMapServer) Run() error {
 	s.router.HandleFunc("/logout", s.logoutHandler)
 
 	// Serve static content
-	if s.config.StaticProxy != "" {
+	if s.staticProxy != nil {
 		log.Info().Msgf("running proxy for static content at  %s", s.config.StaticProxy)
-		err := s.runStaticProxy(s.config.StaticProxy)
-		if err != nil {
-			return err
-		}
-
 		s.router.PathPrefix("/").Handler(s.staticProxy)
 	} else if s.config.StaticDir != "" {
 		s.router.PathPrefix("/").Handler(http.FileServer(http.Dir(s.config.StaticDir)))
@@ -132,46 +263,197 @@ func (s *AtlasMapServer) Run() error {
 	endpoint := fmt.Sprintf("%s:%d", s.config.Host, s.config.Port)
 	log.Info().Msgf("listening on %s", endpoint)
 
-	corsOriginAllowed := os.Getenv("ORIGIN_ALLOWED")
-	if len(corsOriginAllowed) == 0 {
-		return errors.New("cors ORIGIN_ALLOWED not set")
-	}
-	if corsOriginAllowed == "*" {
-		return errors.New("gracefully refusing to allow all origins")
-	}
-
-	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With"})
+	headersOk := handlers.AllowedHeaders([]string{"X-Requested-With", "Content-Type"})
 	originsOk := handlers.AllowedOrigins([]string{corsOriginAllowed})
 	methodsOk := handlers.AllowedMethods([]string{"GET", "HEAD", "POST", "PUT", "OPTIONS"})
 
+	s.server = &http.Server{
+		Addr:    endpoint,
+		Handler: handlers.CORS(originsOk, headersOk, methodsOk)(s.router),
+		BaseContext: func(net.Listener) context.Context {
+			return ctx
+		},
+	}
+
 	log.Info().Msgf("listening on %s", endpoint)
-	return http.ListenAndServe(endpoint, handlers.CORS(originsOk, headersOk, methodsOk)(s.router))
+	errc := make(chan error, 1)
+	go func(server *http.Server) {
+		errc <- server.ListenAndServe()
+	}(s.server)
+	unlock()
+
+	select {
+	case err = <-errc:
+		if errors.Is(err, http.ErrServerClosed) {
+			err = nil
+		}
+	case <-ctx.Done():
+	}
+
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), time.Duration(s.config.ShutdownTimeoutInSeconds)*time.Second)
+	defer cancel()
+	if shutdownErr := s.Shutdown(shutdownCtx); err == nil {
+		err = shutdownErr
+	}
+	return err
 }
 
-func (s *AtlasMapServer) fetch() {
+// Shutdown gracefully stops the server. Streaming clients are disconnected,
+// in-flight requests are drained, tribe subscriptions are canceled and the
+// poller and database are stopped. Shutdown is safe to call more than once,
+// and from another goroutine than Run. Called while Run is setting up, it
+// waits for the setup to finish.
+func (s *AtlasMapServer) Shutdown(ctx context.Context) error {
+	s.shutdownOnce.Do(func() {
+		log.Info().Msg("shutting down")
+		s.mu.Lock()
+		s.shuttingDown = true
+		s.mu.Unlock()
+
+		if s.cancel != nil {
+			s.cancel()
+		}
+
+		if s.server != nil {
+			if err := s.server.Shutdown(ctx); err != nil {
+				log.Error().Err(err).Msg("server.Shutdown")
+				s.shutdownErr = err
+			}
+		}
+
+		if s.broker != nil {
+			s.broker.Close()
+		}
+
+		if s.fetchDone != nil {
+			select {
+			case <-s.fetchDone:
+			case <-ctx.Done():
+				log.Error().Err(ctx.Err()).Msg("waiting for fetch")
+			}
+		}
+
+		if s.brokerRedis != nil {
+			if err := s.brokerRedis.Close(); err != nil {
+				log.Error().Err(err).Msg("brokerRedis.Close")
+			}
+		}
+
+		if s.sessionRedis != nil {
+			if err := s.sessionRedis.Close(); err != nil {
+				log.Error().Err(err).Msg("sessionRedis.Close")
+			}
+		}
+
+		if s.db != nil {
+			if err := s.db.Close(); err != nil {
+				log.Error().Err(err).Msg("db.Close")
+				if s.shutdownErr == nil {
+					s.shutdownErr = err
+				}
+			}
+		}
+	})
+	return s.shutdownErr
+}
+
+// fetch keeps the steamID and playerID maps and the tribe index up to date. After an initial full
+// scan new players are picked up from keyspace notifications when the server
+// publishes them, with the keys scanned one batch per tick in the background
+// to catch missed notifications. Otherwise a full scan is made every tick.
+func (s *AtlasMapServer) fetch(ctx context.Context) {
+	defer close(s.fetchDone)
+
+	playerIDList, err := s.db.GetAllPlayerID(ctx)
+	if err != nil {
+		log.Error().Err(err).Msg("db.GetAllPlayerID")
+	}
+	for _, playerID := range playerIDList {
+		s.addPlayer(ctx, playerID)
+	}
+	s.indexPlayers(ctx, playerIDList)
+
+	// Scans only index new players, tribe changes of known players are
+	// picked up by the slower refresh
+	refresh := time.NewTicker(tribeIndexRefresh)
+	defer refresh.Stop()
+
+	newPlayers, err := s.db.SubNewPlayers(ctx)
+	if err != nil {
+		log.Info().Err(err).Msg("falling back to scanning for new players")
+	}
+	scanner := s.db.NewPlayerScanner(s.config.FetchScanCount)
 
 	throttle := time.NewTicker(time.Duration(s.config.FetchRateInSeconds) * time.Second)
+	defer throttle.Stop()
 
 	for {
-		// Get all players and update maps to include new players
-		playerIDList, err := s.db.GetAllPlayerID(context.Background())
+		select {
+		case playerID, ok := <-newPlayers:
+			if !ok {
+				log.Info().Msg("keyspace notifications closed, falling back to scanning for new players")
+				newPlayers = nil
+				continue
+			}
+			s.addPlayer(ctx, playerID)
+			s.indexPlayers(ctx, []int64{playerID})
+		case <-throttle.C:
+			s.scanPlayers(ctx, scanner, newPlayers == nil)
+		case <-refresh.C:
+			s.indexPlayers(ctx, s.knownPlayerIDs())
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// scanPlayers adds the players of the next scan batch, or of every batch up
+// to the end of the pass when full is set. Only players not seen before are
+// indexed.
+func (s *AtlasMapServer) scanPlayers(ctx context.Context, scanner *atlasdb.PlayerScanner, full bool) {
+	for {
+		playerIDList, done, err := scanner.Next(ctx)
 		if err != nil {
-			log.Error().Err(err).Msg("db.GetAllPlayerID")
-			continue
+			log.Error().Err(err).Msg("scanner.Next")
+			return
 		}
+		added := []int64{}
 		for _, playerID := range playerIDList {
-			if _, ok := s.mapPlayerIDSteamID.Load(playerID); !ok {
-				// fetch from redis
-				steamID, err := s.db.GetSteamIDFromPlayerID(context.Background(), playerID)
-				if err != nil {
-					log.Error().Err(err).Msg("db.GetSteamIDFromPlayerID")
-					continue
-				}
-				s.mapPlayerIDSteamID.Store(playerID, steamID)
-				s.mapSteamIDPlayerID.Store(steamID, playerID)
+			if s.addPlayer(ctx, playerID) {
+				added = append(added, playerID)
 			}
 		}
+		s.indexPlayers(ctx, added)
+		if done || !full || ctx.Err() != nil {
+			return
+		}
+	}
+}
 
-		<-throttle.C
+// addPlayer adds the player to the maps if they are not already known, and
+// reports whether they were added.
+func (s *AtlasMapServer) addPlayer(ctx context.Context, playerID int64) bool {
+	if _, ok := s.mapPlayerIDSteamID.Load(playerID); ok {
+		return false
 	}
+
+	// fetch from redis
+	steamID, err := s.db.GetSteamIDFromPlayerID(ctx, playerID)
+	if err != nil {
+		log.Error().Err(err).Msg("db.GetSteamIDFromPlayerID")
+		return false
+	}
+	s.mapPlayerIDSteamID.Store(playerID, steamID)
+	s.mapSteamIDPlayerID.Store(steamID, playerID)
+	return true
+}
+
+// knownPlayerIDs returns the playerIDs added by fetch.
+func (s *AtlasMapServer) knownPlayerIDs() []int64 {
+	ids := []int64{}
+	s.mapPlayerIDSteamID.Range(func(k, v interface{}) bool {
+		ids = append(ids, k.(int64))
+		return true
+	})
+	return ids
 }
@@ -0,0 +1,64 @@
+package atlasmapserver
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// setRunEnv configures Run to serve on a random port from miniredis.
+func setRunEnv(t *testing.T) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	t.Setenv("PORT", "0")
+	t.Setenv("ORIGIN_ALLOWED", "http://localhost")
+	t.Setenv("SESSION_STORE", "filesystem")
+	t.Setenv("SESSION_PATH", t.TempDir())
+	t.Setenv("BROKER_MODE", "local")
+	t.Setenv("ATLAS_REDIS_ADDRESS", mr.Addr())
+}
+
+func TestShutdownDuringRun(t *testing.T) {
+	setRunEnv(t)
+
+	for _, delay := range []time.Duration{0, time.Millisecond, 10 * time.Millisecond, 100 * time.Millisecond} {
+		t.Run(delay.String(), func(t *testing.T) {
+			s := NewAtlasMapServer()
+			errc := make(chan error, 1)
+			go func() {
+				errc <- s.Run(context.Background())
+			}()
+
+			time.Sleep(delay)
+			if err := s.Shutdown(context.Background()); err != nil {
+				t.Errorf("Shutdown: %v", err)
+			}
+
+			select {
+			case err := <-errc:
+				if err != nil {
+					t.Errorf("Run: %v", err)
+				}
+			case <-time.After(5 * time.Second):
+				t.Fatal("Run still serving after Shutdown")
+			}
+		})
+	}
+}
+
+func TestShutdownBeforeRun(t *testing.T) {
+	setRunEnv(t)
+
+	s := NewAtlasMapServer()
+	if err := s.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Run(context.Background()); err != nil {
+		t.Errorf("Run: %v", err)
+	}
+	if s.server != nil {
+		t.Error("Run started the server after Shutdown")
+	}
+}
@@ -13,6 +13,7 @@ type contextKey int
 
 const (
 	SessionKey contextKey = iota
+	PrincipalKey
 )
 
 func (s *AtlasMapServer) logoutHandler(w http.ResponseWriter, r *http.Request) {
@@ -65,7 +66,7 @@ func (s *AtlasMapServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 			return
 		}
 
-		// Create a new session and store steamID and privileges
+		// Create a new session and store steamID
 		session, err := s.store.New(r, "session")
 		if err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -85,14 +86,6 @@ func (s *AtlasMapServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 		session.Values["steamID"] = steamID
 		session.Values["playerID"] = playerID
 
-		// Set administrator
-		for _, id := range s.config.AdminSteamIDs {
-			if steamID == id {
-				session.Values["admin"] = true
-				break
-			}
-		}
-
 		// Save session and redirect to home
 		if err := session.Save(r, w); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -102,29 +95,3 @@ func (s *AtlasMapServer) loginHandler(w http.ResponseWriter, r *http.Request) {
 		http.Redirect(w, r, "/", http.StatusTemporaryRedirect)
 	}
 }
-
-// Determine if the request is a tribe administrator
-/*
-func (s *AtlasMapServer) isTribeAdmin(r *http.Request) bool {
-	session, err := s.store.Get(r, "session")
-	if err != nil {
-		return false
-	}
-	steamID, ok := session.Values["steamID"].(string)
-	if ok {
-		tribe, err := s.getTribeDataFromSteamID(steamID)
-		if err != nil {
-			return false
-		}
-		admins, ok := tribe["TribeAdmins"]
-		if ok {
-			for _, admin := range strings.Split(strings.Trim(admins, "()[]"), " ") {
-				if steamID == admin {
-					return true
-				}
-			}
-		}
-	}
-
-	return false
-}*/
@@ -1,10 +1,17 @@
 package atlasmapserver
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
 	"os"
 	"strconv"
 	"strings"
+	"time"
 
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver/eventbroker"
 	"github.com/gorilla/securecookie"
 )
 
@@ -14,18 +21,241 @@ type Configuration struct {
 	Port               uint16
 	StaticProxy        string
 	StaticDir          string
+	OriginAllowed      string
 	DisableCommands    bool
 	FetchRateInSeconds int
+	FetchScanCount     int64
 
-	AtlasRedisAddress  string
-	AtlasRedisPassword string
-	AtlasRedisDB       int
+	ShutdownTimeoutInSeconds int
+
+	AtlasRedis RedisConfiguration
+
+	// Separate TribeDB of the Atlas cluster, nil when tribes are in AtlasRedis
+	AtlasTribeRedis *RedisConfiguration
+
+	// Atlas redis timeouts, retries and circuit breaker
+	AtlasRedisDialTimeout      time.Duration
+	AtlasRedisReadTimeout      time.Duration
+	AtlasRedisWriteTimeout     time.Duration
+	AtlasRedisMaxRetries       int
+	AtlasRedisMinRetryBackoff  time.Duration
+	AtlasRedisMaxRetryBackoff  time.Duration
+	AtlasRedisBreakerThreshold int
+	AtlasRedisBreakerCooldown  time.Duration
 
 	AdminSteamIDs []string
 
-	// FS Store for now, may change to redis
-	SessionStore string
-	SessionKey   string
+	// Session storage, "filesystem" or "redis"
+	SessionStoreType string
+	SessionStore     string
+	SessionKey       string
+	SessionMaxAge    int
+	SessionRedis     RedisConfiguration
+
+	// Event broker, "local" or "redis" to coordinate multiple instances
+	BrokerMode  string
+	BrokerRedis RedisConfiguration
+
+	// Events buffered per connection and what to do when the buffer is full
+	BrokerBufferSize int
+	BrokerPolicy     eventbroker.Policy
+
+	// Events kept per tribe for resuming streams
+	BrokerReplaySize            int
+	BrokerReplayWindowInSeconds int
+}
+
+// RedisConfiguration locates a redis server, the sentinels monitoring it when
+// MasterName is set or the nodes of a cluster when Cluster is set.
+type RedisConfiguration struct {
+	Addresses        []string
+	MasterName       string
+	Cluster          bool
+	Username         string
+	Password         string
+	SentinelUsername string
+	SentinelPassword string
+	DB               int
+
+	TLS                   bool
+	TLSCAFile             string
+	TLSCertFile           string
+	TLSKeyFile            string
+	TLSServerName         string
+	TLSInsecureSkipVerify bool
+}
+
+// loadRedisConfig reads the <prefix>_* variables, defaulting to fallback.
+func loadRedisConfig(prefix string, fallback RedisConfiguration) (RedisConfiguration, error) {
+	var err error
+	c := RedisConfiguration{}
+	c.Addresses = strings.Fields(getEnv(prefix+"_ADDRESS", strings.Join(fallback.Addresses, " ")))
+	if len(c.Addresses) == 0 {
+		return c, fmt.Errorf("%s_ADDRESS not set", prefix)
+	}
+	c.MasterName = getEnv(prefix+"_MASTER", fallback.MasterName)
+	c.Cluster, err = strconv.ParseBool(getEnv(prefix+"_CLUSTER", strconv.FormatBool(fallback.Cluster)))
+	if err != nil {
+		return c, err
+	}
+	c.Username = getEnv(prefix+"_USERNAME", fallback.Username)
+	c.Password = getEnv(prefix+"_PASSWORD", fallback.Password)
+	c.SentinelUsername = getEnv(prefix+"_SENTINEL_USERNAME", fallback.SentinelUsername)
+	c.SentinelPassword = getEnv(prefix+"_SENTINEL_PASSWORD", fallback.SentinelPassword)
+	c.DB, err = strconv.Atoi(getEnv(prefix+"_DB", strconv.Itoa(fallback.DB)))
+	if err != nil {
+		return c, err
+	}
+
+	c.TLS, err = strconv.ParseBool(getEnv(prefix+"_TLS", strconv.FormatBool(fallback.TLS)))
+	if err != nil {
+		return c, err
+	}
+	c.TLSCAFile = getEnv(prefix+"_TLS_CA", fallback.TLSCAFile)
+	c.TLSCertFile = getEnv(prefix+"_TLS_CERT", fallback.TLSCertFile)
+	c.TLSKeyFile = getEnv(prefix+"_TLS_KEY", fallback.TLSKeyFile)
+	c.TLSServerName = getEnv(prefix+"_TLS_SERVER_NAME", fallback.TLSServerName)
+	c.TLSInsecureSkipVerify, err = strconv.ParseBool(getEnv(prefix+"_TLS_INSECURE", strconv.FormatBool(fallback.TLSInsecureSkipVerify)))
+	if err != nil {
+		return c, err
+	}
+	if (c.TLSCertFile == "") != (c.TLSKeyFile == "") {
+		return c, fmt.Errorf("%s_TLS_CERT and %s_TLS_KEY must be set together", prefix, prefix)
+	}
+	return c, nil
+}
+
+// connection loads the TLS files and returns the atlasdb connection.
+func (c *RedisConfiguration) connection() (atlasdb.Connection, error) {
+	conn := atlasdb.Connection{
+		Addresses:        c.Addresses,
+		MasterName:       c.MasterName,
+		Cluster:          c.Cluster,
+		Username:         c.Username,
+		Password:         c.Password,
+		SentinelUsername: c.SentinelUsername,
+		SentinelPassword: c.SentinelPassword,
+		DB:               c.DB,
+	}
+	if !c.TLS {
+		return conn, nil
+	}
+
+	conn.TLSConfig = &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         c.TLSServerName,
+		InsecureSkipVerify: c.TLSInsecureSkipVerify,
+	}
+	if c.TLSCAFile != "" {
+		pem, err := os.ReadFile(c.TLSCAFile)
+		if err != nil {
+			return conn, err
+		}
+		conn.TLSConfig.RootCAs = x509.NewCertPool()
+		if !conn.TLSConfig.RootCAs.AppendCertsFromPEM(pem) {
+			return conn, fmt.Errorf("no certificates found in %s", c.TLSCAFile)
+		}
+	}
+	if c.TLSCertFile != "" {
+		cert, err := tls.LoadX509KeyPair(c.TLSCertFile, c.TLSKeyFile)
+		if err != nil {
+			return conn, err
+		}
+		conn.TLSConfig.Certificates = []tls.Certificate{cert}
+	}
+	return conn, nil
+}
+
+// loadAtlasConfig reads the Atlas redis connection variables.
+func (c *Configuration) loadAtlasConfig() error {
+	var err error
+	c.AtlasRedis, err = loadRedisConfig("ATLAS_REDIS", RedisConfiguration{Addresses: []string{"localhost:6379"}})
+	if err != nil {
+		return err
+	}
+
+	// The TribeDB inherits the settings of the default server
+	if _, ok := os.LookupEnv("ATLAS_TRIBE_REDIS_ADDRESS"); ok {
+		tribe, err := loadRedisConfig("ATLAS_TRIBE_REDIS", c.AtlasRedis)
+		if err != nil {
+			return err
+		}
+		c.AtlasTribeRedis = &tribe
+	}
+
+	c.AtlasRedisDialTimeout, err = time.ParseDuration(getEnv("ATLAS_REDIS_DIAL_TIMEOUT", "5s"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisReadTimeout, err = time.ParseDuration(getEnv("ATLAS_REDIS_READ_TIMEOUT", "3s"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisWriteTimeout, err = time.ParseDuration(getEnv("ATLAS_REDIS_WRITE_TIMEOUT", "3s"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisMaxRetries, err = strconv.Atoi(getEnv("ATLAS_REDIS_MAX_RETRIES", "3"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisMinRetryBackoff, err = time.ParseDuration(getEnv("ATLAS_REDIS_MIN_RETRY_BACKOFF", "8ms"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisMaxRetryBackoff, err = time.ParseDuration(getEnv("ATLAS_REDIS_MAX_RETRY_BACKOFF", "512ms"))
+	if err != nil {
+		return err
+	}
+	c.AtlasRedisBreakerThreshold, err = strconv.Atoi(getEnv("ATLAS_REDIS_BREAKER_THRESHOLD", "5"))
+	if err != nil {
+		return err
+	}
+	if c.AtlasRedisBreakerThreshold < 0 {
+		return fmt.Errorf("ATLAS_REDIS_BREAKER_THRESHOLD must not be negative")
+	}
+	c.AtlasRedisBreakerCooldown, err = time.ParseDuration(getEnv("ATLAS_REDIS_BREAKER_COOLDOWN", "10s"))
+	if err != nil {
+		return err
+	}
+	return nil
+}
+
+// atlasDBOptions loads the TLS files and returns the atlasdb options.
+func (c *Configuration) atlasDBOptions() (atlasdb.Options, error) {
+	conn, err := c.AtlasRedis.connection()
+	if err != nil {
+		return atlasdb.Options{}, err
+	}
+	opts := atlasdb.Options{
+		Connection:       conn,
+		DialTimeout:      c.AtlasRedisDialTimeout,
+		ReadTimeout:      c.AtlasRedisReadTimeout,
+		WriteTimeout:     c.AtlasRedisWriteTimeout,
+		MaxRetries:       c.AtlasRedisMaxRetries,
+		MinRetryBackoff:  c.AtlasRedisMinRetryBackoff,
+		MaxRetryBackoff:  c.AtlasRedisMaxRetryBackoff,
+		BreakerThreshold: c.AtlasRedisBreakerThreshold,
+		BreakerCooldown:  c.AtlasRedisBreakerCooldown,
+	}
+	if c.AtlasTribeRedis != nil {
+		tribe, err := c.AtlasTribeRedis.connection()
+		if err != nil {
+			return opts, err
+		}
+		opts.Tribe = &tribe
+	}
+	return opts, nil
+}
+
+// AtlasDBOptions reads the Atlas redis options from the environment the same
+// way as the server, for tools connecting to the same Atlas redis.
+func AtlasDBOptions() (atlasdb.Options, error) {
+	c := &Configuration{}
+	if err := c.loadAtlasConfig(); err != nil {
+		return atlasdb.Options{}, err
+	}
+	return c.atlasDBOptions()
 }
 
 func getEnv(key, fallback string) string {
@@ -54,18 +284,79 @@ func (s *AtlasMapServer) loadConfig() error {
 		return err
 	}
 
+	s.config.FetchScanCount, err = strconv.ParseInt(getEnv("FETCHSCANCOUNT", "1000"), 10, 64)
+	if err != nil {
+		return err
+	}
+
+	s.config.ShutdownTimeoutInSeconds, err = strconv.Atoi(getEnv("SHUTDOWN_TIMEOUT", "30"))
+	if err != nil {
+		return err
+	}
+
 	s.config.StaticDir = getEnv("STATICDIR", "")
 	s.config.StaticProxy = getEnv("STATICPROXY", "")
+	s.config.OriginAllowed = getEnv("ORIGIN_ALLOWED", "")
 
+	s.config.SessionStoreType = getEnv("SESSION_STORE", "filesystem")
+	if s.config.SessionStoreType != "filesystem" && s.config.SessionStoreType != "redis" {
+		return fmt.Errorf("unknown SESSION_STORE %q", s.config.SessionStoreType)
+	}
 	s.config.SessionStore = getEnv("SESSION_PATH", "./store")
+	// Sessions shared through redis must be readable by every instance
+	if _, ok := os.LookupEnv("SESSION_KEY"); !ok && s.config.SessionStoreType == "redis" {
+		return errors.New("SESSION_KEY must be set with SESSION_STORE=redis")
+	}
 	s.config.SessionKey = getEnv("SESSION_KEY", string(securecookie.GenerateRandomKey(32)))
+	s.config.SessionMaxAge, err = strconv.Atoi(getEnv("SESSION_MAX_AGE", "2400"))
+	if err != nil {
+		return err
+	}
+	if s.config.SessionStoreType == "redis" {
+		s.config.SessionRedis, err = loadRedisConfig("SESSION_REDIS", RedisConfiguration{Addresses: []string{"localhost:6379"}})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.config.BrokerMode = getEnv("BROKER_MODE", "local")
+	if s.config.BrokerMode != "local" && s.config.BrokerMode != "redis" {
+		return fmt.Errorf("unknown BROKER_MODE %q", s.config.BrokerMode)
+	}
+	if s.config.BrokerMode == "redis" {
+		s.config.BrokerRedis, err = loadRedisConfig("BROKER_REDIS", RedisConfiguration{Addresses: []string{"localhost:6379"}})
+		if err != nil {
+			return err
+		}
+	}
+
+	s.config.BrokerBufferSize, err = strconv.Atoi(getEnv("BROKER_BUFFER", "100"))
+	if err != nil {
+		return err
+	}
+	if s.config.BrokerBufferSize < 1 {
+		return fmt.Errorf("BROKER_BUFFER must be positive")
+	}
+	s.config.BrokerPolicy, err = eventbroker.ParsePolicy(getEnv("BROKER_POLICY", "coalesce"))
+	if err != nil {
+		return err
+	}
 
-	s.config.AtlasRedisAddress = getEnv("ATLAS_REDIS_ADDRESS", "localhost:6379")
-	s.config.AtlasRedisPassword = getEnv("ATLAS_REDIS_PASSWORD", "")
-	s.config.AtlasRedisDB, err = strconv.Atoi(getEnv("ATLAS_REDIS_DB", "0"))
+	s.config.BrokerReplaySize, err = strconv.Atoi(getEnv("BROKER_REPLAY", "256"))
 	if err != nil {
 		return err
 	}
+	if s.config.BrokerReplaySize < 0 {
+		return fmt.Errorf("BROKER_REPLAY must not be negative")
+	}
+	s.config.BrokerReplayWindowInSeconds, err = strconv.Atoi(getEnv("BROKER_REPLAY_WINDOW", "120"))
+	if err != nil {
+		return err
+	}
+
+	if err := s.config.loadAtlasConfig(); err != nil {
+		return err
+	}
 
 	s.config.AdminSteamIDs = strings.Split(getEnv("ADMIN_STEAMID_LIST", ""), " ")
 
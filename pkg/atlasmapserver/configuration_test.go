@@ -0,0 +1,58 @@
+package atlasmapserver
+
+import (
+	"os"
+	"testing"
+)
+
+func TestLoadConfigSessionKey(t *testing.T) {
+	s := NewAtlasMapServer()
+
+	// Restored after the test by Setenv
+	t.Setenv("SESSION_KEY", "")
+	os.Unsetenv("SESSION_KEY")
+
+	t.Setenv("SESSION_STORE", "redis")
+	if err := s.loadConfig(); err == nil {
+		t.Error("expected SESSION_STORE=redis to require SESSION_KEY")
+	}
+
+	t.Setenv("SESSION_KEY", "0123456789abcdef0123456789abcdef")
+	if err := s.loadConfig(); err != nil {
+		t.Errorf("loadConfig: %v", err)
+	}
+}
+
+func TestLoadConfigRedis(t *testing.T) {
+	s := NewAtlasMapServer()
+	t.Setenv("SESSION_STORE", "redis")
+	t.Setenv("SESSION_KEY", "0123456789abcdef0123456789abcdef")
+	t.Setenv("SESSION_REDIS_ADDRESS", "sentinel1:26379 sentinel2:26379")
+	t.Setenv("SESSION_REDIS_MASTER", "sessions")
+	t.Setenv("SESSION_REDIS_USERNAME", "atlasmap")
+	t.Setenv("SESSION_REDIS_TLS", "true")
+	t.Setenv("BROKER_MODE", "redis")
+	t.Setenv("BROKER_REDIS_ADDRESS", "node1:6379 node2:6379 node3:6379")
+	t.Setenv("BROKER_REDIS_CLUSTER", "true")
+
+	if err := s.loadConfig(); err != nil {
+		t.Fatalf("loadConfig: %v", err)
+	}
+
+	session := s.config.SessionRedis
+	if len(session.Addresses) != 2 || session.MasterName != "sessions" || session.Username != "atlasmap" || !session.TLS {
+		t.Errorf("unexpected session redis %+v", session)
+	}
+	conn, err := session.connection()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if conn.TLSConfig == nil {
+		t.Error("session redis connection without TLS")
+	}
+
+	broker := s.config.BrokerRedis
+	if len(broker.Addresses) != 3 || !broker.Cluster {
+		t.Errorf("unexpected broker redis %+v", broker)
+	}
+}
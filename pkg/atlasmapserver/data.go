@@ -11,7 +11,7 @@ func (s *AtlasMapServer) GetPlayerIDFromSteamID(steamID string) (int64, error) {
 }
 
 func (s *AtlasMapServer) GetSteamIDFromPlayerID(playerID int64) (string, error) {
-	steamID, ok := s.mapSteamIDPlayerID.Load(playerID)
+	steamID, ok := s.mapPlayerIDSteamID.Load(playerID)
 	if ok {
 		return steamID.(string), nil
 	}
@@ -0,0 +1,187 @@
+package eventbroker
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/go-redis/redis/v8"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// Channels on the coordination redis
+	tribeChannel = "atlasmap:tribe:"
+	userChannel  = "atlasmap:user:"
+
+	// Only the instance holding the leader key subscribes to the game redis
+	leaderKey = "atlasmap:broker:leader"
+	leaderTTL = 15 * time.Second
+)
+
+var (
+	extendLeader  = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("PEXPIRE", KEYS[1], ARGV[2]) else return 0 end`)
+	releaseLeader = redis.NewScript(`if redis.call("GET", KEYS[1]) == ARGV[1] then return redis.call("DEL", KEYS[1]) else return 0 end`)
+)
+
+// NewDistributedEventBroker creates a broker that coordinates with the other
+// instances sharing the coordination redis. One elected instance holds a single
+// pattern subscription to the game redis and publishes the tribe events to
+// the coordination redis; every instance fans out the events it receives from
+// there to its own connections. User messages are published the same way so
+// they reach the instance holding the user's connection.
+func NewDistributedEventBroker(db *atlasdb.AtlasDB, coord redis.UniversalClient, opts Options) *EventBroker {
+	ctx, cancel := context.WithCancel(context.Background())
+	s := &EventBroker{
+		db:         db,
+		opts:       opts,
+		replay:     make(map[int64]*replayBuffer),
+		coord:      coord,
+		instanceID: newInstanceID(),
+		cancel:     cancel,
+	}
+
+	s.wg.Add(2)
+	go s.runFanOut(ctx)
+	go s.runLeaderElection(ctx)
+	return s
+}
+
+func newInstanceID() string {
+	b := make([]byte, 8)
+	if _, err := rand.Read(b); err != nil {
+		panic(err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// publish sends the event to every instance.
+func (s *EventBroker) publish(channel string, value atlasdb.Event) error {
+	v, err := json.Marshal(value)
+	if err != nil {
+		return err
+	}
+	return s.coord.Publish(context.Background(), channel, v).Err()
+}
+
+// runFanOut delivers the events published by any instance to the local
+// connections.
+func (s *EventBroker) runFanOut(ctx context.Context) {
+	defer s.wg.Done()
+
+	sub := s.coord.PSubscribe(ctx, tribeChannel+"*", userChannel+"*")
+	defer sub.Close()
+
+	messages := sub.Channel()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case msg, ok := <-messages:
+			if !ok {
+				return
+			}
+
+			e := atlasdb.Event{}
+			if err := json.Unmarshal([]byte(msg.Payload), &e); err != nil {
+				log.Err(err).Msgf("broker decoding %s", msg.Channel)
+				continue
+			}
+
+			// Not found errors only mean nobody is connected to this instance
+			switch {
+			case strings.HasPrefix(msg.Channel, tribeChannel):
+				tribeID, err := strconv.ParseInt(strings.TrimPrefix(msg.Channel, tribeChannel), 10, 64)
+				if err != nil {
+					log.Err(err).Msgf("broker channel %s", msg.Channel)
+					continue
+				}
+				s.sendTribeLocal(tribeID, e)
+			case strings.HasPrefix(msg.Channel, userChannel):
+				s.sendUserLocal(strings.TrimPrefix(msg.Channel, userChannel), e)
+			}
+		}
+	}
+}
+
+// runLeaderElection keeps trying to become, or remain, the instance relaying
+// the game redis. The relay is stopped as soon as leadership is lost.
+func (s *EventBroker) runLeaderElection(ctx context.Context) {
+	defer s.wg.Done()
+
+	ticker := time.NewTicker(leaderTTL / 3)
+	defer ticker.Stop()
+
+	var stopRelay func()
+	defer func() {
+		if stopRelay != nil {
+			stopRelay()
+			s.releaseLeadership()
+		}
+	}()
+
+	for {
+		leader := s.holdLeadership(ctx)
+		if leader && stopRelay == nil {
+			log.Info().Msgf("broker %s relaying tribe events", s.instanceID)
+			relayCtx, cancel := context.WithCancel(ctx)
+			stopRelay = cancel
+			s.wg.Add(1)
+			go s.relay(relayCtx)
+		} else if !leader && stopRelay != nil {
+			log.Info().Msgf("broker %s lost leadership", s.instanceID)
+			stopRelay()
+			stopRelay = nil
+		}
+
+		select {
+		case <-ticker.C:
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// holdLeadership acquires or extends the leader key.
+func (s *EventBroker) holdLeadership(ctx context.Context) bool {
+	ok, err := s.coord.SetNX(ctx, leaderKey, s.instanceID, leaderTTL).Result()
+	if err != nil {
+		log.Err(err).Msg("broker leader election")
+		return false
+	}
+	if ok {
+		return true
+	}
+
+	n, err := extendLeader.Run(ctx, s.coord, []string{leaderKey}, s.instanceID, leaderTTL.Milliseconds()).Int()
+	if err != nil {
+		log.Err(err).Msg("broker leader election")
+		return false
+	}
+	return n == 1
+}
+
+// releaseLeadership gives up the leader key so another instance can take over
+// without waiting for it to expire.
+func (s *EventBroker) releaseLeadership() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := releaseLeader.Run(ctx, s.coord, []string{leaderKey}, s.instanceID).Err(); err != nil {
+		log.Err(err).Msg("broker releasing leadership")
+	}
+}
+
+// relay publishes the events of every tribe to the coordination redis.
+func (s *EventBroker) relay(ctx context.Context) {
+	defer s.wg.Done()
+	for te := range s.db.SubAllTribes(ctx) {
+		if err := s.publish(tribeChannel+strconv.FormatInt(te.TribeID, 10), te.Event); err != nil {
+			log.Err(err).Msg("broker relay")
+		}
+	}
+}
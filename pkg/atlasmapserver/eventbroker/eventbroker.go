@@ -3,65 +3,164 @@ package eventbroker
 import (
 	"context"
 	"errors"
+	"strconv"
 	"sync"
+	"time"
 
 	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/go-redis/redis/v8"
 	"github.com/rs/zerolog/log"
 )
 
 type EventBroker struct {
-	users       sync.Map
-	usersMut    sync.Mutex
-	tribes      sync.Map
-	tribesMut   sync.Mutex
-	db          *atlasdb.AtlasDB
-	tribeCancel map[int64]context.CancelFunc
+	users     sync.Map
+	usersMut  sync.Mutex
+	tribes    sync.Map
+	tribesMut sync.Mutex
+	db        *atlasdb.AtlasDB
+	opts      Options
+	stats     stats
+
+	// Single pattern subscription to every tribe, held while any tribe has
+	// subscribers or replay buffer. Guarded by tribesMut.
+	tribeCount  int
+	tribeCancel context.CancelFunc
+	replay      map[int64]*replayBuffer
+
+	// Subscribers to every tribe. Guarded by tribesMut.
+	watchers []*Subscriber
+
+	// Latest presence of players from MemberPresenceUpdated events
+	presence sync.Map
+
+	// Numbers event IDs of this broker
+	instanceID string
+
+	// Distributed mode, see NewDistributedEventBroker
+	coord  redis.UniversalClient
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
 }
 
-func NewEventBroker(db *atlasdb.AtlasDB) *EventBroker {
+func NewEventBroker(db *atlasdb.AtlasDB, opts Options) *EventBroker {
 	return &EventBroker{
-		db:          db,
-		tribeCancel: make(map[int64]context.CancelFunc),
+		db:         db,
+		opts:       opts,
+		replay:     make(map[int64]*replayBuffer),
+		instanceID: newInstanceID(),
 	}
 }
 
-func (s *EventBroker) AddUser(steamID string, tribeID int64) chan string {
-	channel := make(chan string, 20)
+// AddUser creates a subscriber receiving the events of the user and tribe.
+// When lastEventID names an event still held for the tribe, the events after
+// it are replayed to the subscriber and true is returned.
+func (s *EventBroker) AddUser(steamID string, tribeID int64, lastEventID string) (*Subscriber, bool) {
+	sub := newSubscriber(s.opts, &s.stats)
 	s.usersMut.Lock()
-	usersInterface, loaded := s.users.LoadOrStore(steamID, []chan string{channel})
+	usersInterface, loaded := s.users.LoadOrStore(steamID, []*Subscriber{sub})
 	if loaded {
-		users := usersInterface.([]chan string)
-		s.users.Store(steamID, append(users, channel))
+		users := usersInterface.([]*Subscriber)
+		s.users.Store(steamID, append(users, sub))
 	}
 	s.usersMut.Unlock()
 
+	return sub, s.Subscribe(sub, tribeID, lastEventID)
+}
+
+// AddWatcher creates a subscriber receiving the events of every tribe that
+// pass the filter.
+func (s *EventBroker) AddWatcher(filter Filter) *Subscriber {
+	sub := newSubscriber(s.opts, &s.stats)
+	sub.filter = &filter
+
+	s.tribesMut.Lock()
+	s.watchers = append(s.watchers, sub)
+	s.subTribe()
+	s.tribesMut.Unlock()
+	return sub
+}
+
+// Subscribe adds the events of another tribe to the subscriber, replaying the
+// events after lastEventID as AddUser does.
+func (s *EventBroker) Subscribe(sub *Subscriber, tribeID int64, lastEventID string) bool {
 	s.tribesMut.Lock()
-	tribesInterface, loaded := s.tribes.LoadOrStore(tribeID, []chan string{channel})
-	tribes := tribesInterface.([]chan string)
+	defer s.tribesMut.Unlock()
+
+	tribesInterface, loaded := s.tribes.LoadOrStore(tribeID, []*Subscriber{sub})
 	if loaded {
-		s.tribes.Store(tribeID, append(tribes, channel))
+		tribes := tribesInterface.([]*Subscriber)
+		for _, t := range tribes {
+			if t == sub {
+				return false
+			}
+		}
+		s.tribes.Store(tribeID, append(tribes, sub))
 	}
 
-	// subscribe to tribe channel and save cancel function
-	log.Debug().Msgf("subscribing to tribe %d  known tribes: %d  subbed before: %v", tribeID, len(tribes), loaded)
-	if !loaded || len(tribes) == 0 {
-		s.tribeCancel[tribeID] = s.subTribe(tribeID)
+	// count the tribe towards the shared subscription
+	buf, known := s.replay[tribeID]
+	if !known {
+		log.Debug().Msgf("subscribing to tribe %d  known tribes: %d", tribeID, s.tribeCount+1)
+		buf = newReplayBuffer(s.opts.ReplaySize)
+		s.replay[tribeID] = buf
+		s.subTribe()
+	} else if buf.linger != nil {
+		buf.linger.Stop()
+		buf.linger = nil
 	}
 
-	s.tribesMut.Unlock()
-	return channel
+	if epoch, seq, ok := parseEventID(lastEventID); ok && epoch == s.instanceID {
+		if events, ok := buf.since(seq); ok {
+			sub.preload(events)
+			return true
+		}
+	}
+	return false
+}
+
+// Unsubscribe stops delivering the events of the tribe to the subscriber.
+func (s *EventBroker) Unsubscribe(sub *Subscriber, tribeID int64) {
+	s.tribesMut.Lock()
+	defer s.tribesMut.Unlock()
+	s.removeTribeSubscriber(tribeID, sub)
+}
+
+// removeTribeSubscriber removes the subscriber from the tribe, releasing the
+// tribe after its last subscriber. tribesMut must be held.
+func (s *EventBroker) removeTribeSubscriber(tribeID int64, sub *Subscriber) {
+	v, ok := s.tribes.Load(tribeID)
+	if !ok {
+		return
+	}
+	tribes := v.([]*Subscriber)
+	changed := false
+	for i := len(tribes) - 1; i >= 0; i-- {
+		if tribes[i] == sub {
+			tribes = append(tribes[:i], tribes[i+1:]...)
+			changed = true
+		}
+	}
+
+	// if there are no channels left, stop counting the tribe
+	if changed && len(tribes) == 0 {
+		s.tribes.Delete(tribeID)
+		s.releaseTribe(tribeID)
+	} else if changed {
+		s.tribes.Store(tribeID, tribes)
+	}
 }
 
-func (s *EventBroker) RemoveChannel(channel chan string) {
+// RemoveSubscriber stops delivering events to the subscriber and closes it.
+func (s *EventBroker) RemoveSubscriber(sub *Subscriber) {
 	s.usersMut.Lock()
 	s.tribesMut.Lock()
 
 	// Remove any user channels
 	s.users.Range(func(k, v interface{}) bool {
-		users := v.([]chan string)
+		users := v.([]*Subscriber)
 		changed := false
 		for i := len(users) - 1; i >= 0; i-- {
-			if users[i] == channel {
+			if users[i] == sub {
 				users = append(users[:i], users[i+1:]...)
 				changed = true
 			}
@@ -75,77 +174,171 @@ func (s *EventBroker) RemoveChannel(channel chan string) {
 
 	// Remove any tribe channels
 	s.tribes.Range(func(k, v interface{}) bool {
-		tribes := v.([]chan string)
-		changed := false
-		for i := len(tribes) - 1; i >= 0; i-- {
-			if tribes[i] == channel {
-				tribes = append(tribes[:i], tribes[i+1:]...)
-				changed = true
-			}
-		}
-
-		// if there are no channels left, cancel the context
-		if len(tribes) == 0 {
-			if _, ok := s.tribeCancel[k.(int64)]; ok {
-				log.Debug().Msgf("canceling tribe %d", k)
-				s.tribeCancel[k.(int64)]()
-				delete(s.tribeCancel, k.(int64))
-			}
-		}
-
-		// Store if there were changes
-		if changed {
-			s.tribes.Store(k, tribes)
-		}
+		s.removeTribeSubscriber(k.(int64), sub)
 		return true
 	})
+	for i := len(s.watchers) - 1; i >= 0; i-- {
+		if s.watchers[i] == sub {
+			s.watchers = append(s.watchers[:i], s.watchers[i+1:]...)
+			s.unsubTribe()
+		}
+	}
 
 	s.usersMut.Unlock()
 	s.tribesMut.Unlock()
 
-	close(channel)
+	sub.close(ErrSubscriberClosed)
 }
 
-func (s *EventBroker) SendUser(steamID string, value string) error {
+// Stats returns the events dropped, coalesced and subscribers disconnected
+// because they fell behind.
+func (s *EventBroker) Stats() Stats {
+	return s.stats.snapshot()
+}
+
+// Close cancels the tribe subscription and stops coordinating with other
+// instances.
+func (s *EventBroker) Close() {
+	if s.cancel != nil {
+		s.cancel()
+		s.wg.Wait()
+	}
+
+	s.tribesMut.Lock()
+	for tribeID, buf := range s.replay {
+		if buf.linger != nil {
+			buf.linger.Stop()
+		}
+		delete(s.replay, tribeID)
+	}
+	if s.tribeCancel != nil {
+		s.tribeCancel()
+		s.tribeCancel = nil
+	}
+	s.tribesMut.Unlock()
+}
+
+// SendUser sends the event to every connection of the user. In distributed
+// mode the event is published to all instances.
+func (s *EventBroker) SendUser(steamID string, value atlasdb.Event) error {
+	if s.coord != nil {
+		return s.publish(userChannel+steamID, value)
+	}
+	return s.sendUserLocal(steamID, value)
+}
+
+// SendTribe sends the event to every connection subscribed to the tribe. In
+// distributed mode the event is published to all instances.
+func (s *EventBroker) SendTribe(tribeID int64, value atlasdb.Event) error {
+	if s.coord != nil {
+		return s.publish(tribeChannel+strconv.FormatInt(tribeID, 10), value)
+	}
+	return s.sendTribeLocal(tribeID, value)
+}
+
+func (s *EventBroker) sendUserLocal(steamID string, value atlasdb.Event) error {
 	v, ok := s.users.Load(steamID)
 	if !ok {
 		return errors.New("steamID not found")
 	}
-	for _, c := range v.([]chan string) {
-		c <- value
+	for _, sub := range v.([]*Subscriber) {
+		sub.send(value)
 	}
 
 	return nil
 }
 
-func (s *EventBroker) SendTribe(tribeID int64, value string) error {
+func (s *EventBroker) sendTribeLocal(tribeID int64, value atlasdb.Event) error {
+	if p, ok := value.Payload.(atlasdb.TribeMemberPresence); ok {
+		s.presence.Store(int64(p.PlayerID), p)
+	}
+
+	// Numbering and delivery are atomic with AddUser so resumed subscribers
+	// neither miss nor repeat events
+	s.tribesMut.Lock()
+	defer s.tribesMut.Unlock()
+	value.TribeID = tribeID
+	if buf, ok := s.replay[tribeID]; ok {
+		buf.add(s.instanceID, &value)
+	}
+
+	for _, sub := range s.watchers {
+		if sub.filter.Match(tribeID, value) {
+			sub.send(value)
+		}
+	}
+
 	v, ok := s.tribes.Load(tribeID)
 	if !ok {
 		return errors.New("tribeID not found")
 	}
-	for _, c := range v.([]chan string) {
-		c <- value
+	for _, sub := range v.([]*Subscriber) {
+		sub.send(value)
 	}
 
 	return nil
 }
 
-func (s *EventBroker) subTribe(tribeID int64) context.CancelFunc {
+// MemberPresence returns the latest presence event seen for the player.
+func (s *EventBroker) MemberPresence(playerID int64) (atlasdb.TribeMemberPresence, bool) {
+	v, ok := s.presence.Load(playerID)
+	if !ok {
+		return atlasdb.TribeMemberPresence{}, false
+	}
+	return v.(atlasdb.TribeMemberPresence), true
+}
+
+// subTribe counts a newly subscribed tribe, starting the pattern subscription
+// for the first one. tribesMut must be held.
+func (s *EventBroker) subTribe() {
+	s.tribeCount++
+
+	// The leader relays every tribe in distributed mode
+	if s.coord != nil || s.tribeCancel != nil {
+		return
+	}
+
 	ctx, cancel := context.WithCancel(context.Background())
-	c := s.db.SubTribe(ctx, tribeID)
+	s.tribeCancel = cancel
+	c := s.db.SubAllTribes(ctx)
 	go func() {
-		for {
-			select {
-			case msg := <-c:
-				if err := s.SendTribe(tribeID, msg); err != nil {
-					// exit out and close the channel
-					log.Err(err).Msg("broker.sendtribe")
-					return
-				}
-			case <-ctx.Done():
-				return
-			}
+		for msg := range c {
+			// Events for tribes without subscribers still update presence
+			s.sendTribeLocal(msg.TribeID, msg.Event)
 		}
 	}()
-	return cancel
+}
+
+// releaseTribe keeps the replay buffer of a tribe without subscribers for the
+// replay window before it stops being counted. tribesMut must be held.
+func (s *EventBroker) releaseTribe(tribeID int64) {
+	buf, ok := s.replay[tribeID]
+	if !ok {
+		return
+	}
+
+	var linger *time.Timer
+	linger = time.AfterFunc(s.opts.ReplayWindow, func() {
+		s.tribesMut.Lock()
+		defer s.tribesMut.Unlock()
+
+		// A subscriber returned in the meantime
+		if buf.linger != linger {
+			return
+		}
+		log.Debug().Msgf("canceling tribe %d", tribeID)
+		delete(s.replay, tribeID)
+		s.unsubTribe()
+	})
+	buf.linger = linger
+}
+
+// unsubTribe stops counting a tribe without subscribers, canceling the pattern
+// subscription after the last one. tribesMut must be held.
+func (s *EventBroker) unsubTribe() {
+	s.tribeCount--
+	if s.tribeCount == 0 && s.tribeCancel != nil {
+		s.tribeCancel()
+		s.tribeCancel = nil
+	}
 }
@@ -0,0 +1,81 @@
+package eventbroker
+
+import (
+	"strings"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+)
+
+// Filter selects the events delivered to a subscriber of every tribe. Each
+// non empty field must match. Events without an entity type or server do not
+// match filters on them.
+type Filter struct {
+	TribeIDs    []int64
+	ServerIDs   []uint32
+	EntityTypes []string
+	Kinds       []atlasdb.EventKind
+}
+
+// Match determines if the event of the tribe passes the filter.
+func (f *Filter) Match(tribeID int64, e atlasdb.Event) bool {
+	if len(f.TribeIDs) > 0 && !containsInt64(f.TribeIDs, tribeID) {
+		return false
+	}
+	if len(f.Kinds) > 0 && !containsKind(f.Kinds, e.Kind) {
+		return false
+	}
+
+	update, isEntity := e.Payload.(atlasdb.TribeEntityUpdate)
+	if len(f.EntityTypes) > 0 {
+		if !isEntity || !containsFold(f.EntityTypes, update.EntityType) {
+			return false
+		}
+	}
+	if len(f.ServerIDs) > 0 {
+		// Entities report the server they are on, other events their source
+		serverID := e.ServerID
+		if isEntity {
+			serverID = update.ServerID
+		}
+		if !containsUint32(f.ServerIDs, serverID) {
+			return false
+		}
+	}
+	return true
+}
+
+func containsInt64(list []int64, v int64) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsUint32(list []uint32, v uint32) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsKind(list []atlasdb.EventKind, v atlasdb.EventKind) bool {
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+func containsFold(list []string, v string) bool {
+	for _, l := range list {
+		if strings.EqualFold(l, v) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,75 @@
+package eventbroker
+
+import (
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+)
+
+// replayBuffer numbers the events of a tribe and keeps the latest of them so
+// reconnecting subscribers receive only the events they missed.
+type replayBuffer struct {
+	ring  []atlasdb.Event
+	next  int    // index of the next write
+	count int    // events held
+	last  uint64 // sequence of the newest event
+
+	// Set while the tribe has no subscribers, dropping the buffer on expiry
+	linger *time.Timer
+}
+
+func newReplayBuffer(size int) *replayBuffer {
+	return &replayBuffer{
+		ring: make([]atlasdb.Event, size),
+	}
+}
+
+// add assigns the next sequence of the tribe to the event and keeps it.
+func (r *replayBuffer) add(epoch string, e *atlasdb.Event) {
+	r.last++
+	e.ID = formatEventID(epoch, r.last)
+	if len(r.ring) == 0 {
+		return
+	}
+
+	r.ring[r.next] = *e
+	r.next = (r.next + 1) % len(r.ring)
+	if r.count < len(r.ring) {
+		r.count++
+	}
+}
+
+// since returns the events following the sequence, or false when some of them
+// are no longer held.
+func (r *replayBuffer) since(seq uint64) ([]atlasdb.Event, bool) {
+	if seq > r.last || r.last-seq > uint64(r.count) {
+		return nil, false
+	}
+
+	missed := int(r.last - seq)
+	events := make([]atlasdb.Event, 0, missed)
+	for i := missed; i > 0; i-- {
+		events = append(events, r.ring[(r.next-i+len(r.ring))%len(r.ring)])
+	}
+	return events, true
+}
+
+// formatEventID formats the sequence as an SSE event ID. The epoch identifies
+// the broker that numbered the event, as sequences restart with the broker.
+func formatEventID(epoch string, seq uint64) string {
+	return epoch + "-" + strconv.FormatUint(seq, 10)
+}
+
+func parseEventID(id string) (string, uint64, bool) {
+	i := strings.LastIndexByte(id, '-')
+	if i < 0 {
+		return "", 0, false
+	}
+	seq, err := strconv.ParseUint(id[i+1:], 10, 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return id[:i], seq, true
+}
@@ -0,0 +1,265 @@
+package eventbroker
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+)
+
+// Policy decides what happens to an event sent to a subscriber whose buffer
+// is full.
+type Policy string
+
+const (
+	// PolicyDropOldest discards the oldest buffered event.
+	PolicyDropOldest Policy = "drop-oldest"
+
+	// PolicyCoalesce discards a buffered update of the same entity, falling
+	// back to discarding the oldest buffered event.
+	PolicyCoalesce Policy = "coalesce"
+
+	// PolicyDisconnect closes the subscriber.
+	PolicyDisconnect Policy = "disconnect"
+)
+
+// ParsePolicy validates a policy name.
+func ParsePolicy(name string) (Policy, error) {
+	switch p := Policy(name); p {
+	case PolicyDropOldest, PolicyCoalesce, PolicyDisconnect:
+		return p, nil
+	}
+	return "", fmt.Errorf("unknown broker policy %q", name)
+}
+
+// Options configure the buffering of subscribers.
+type Options struct {
+	// BufferSize is the number of events buffered per subscriber.
+	BufferSize int
+
+	// Policy applied when the buffer is full.
+	Policy Policy
+
+	// ReplaySize is the number of events kept per tribe for resuming.
+	ReplaySize int
+
+	// ReplayWindow is how long events are kept after the last subscriber of a
+	// tribe leaves.
+	ReplayWindow time.Duration
+}
+
+var (
+	// ErrSubscriberClosed is returned by Next after the subscriber is removed.
+	ErrSubscriberClosed = errors.New("subscriber closed")
+
+	// ErrSlowConsumer is returned by Next after the subscriber is disconnected
+	// by PolicyDisconnect.
+	ErrSlowConsumer = errors.New("subscriber disconnected for falling behind")
+)
+
+// Stats counts events not delivered as sent because subscribers fell behind.
+type Stats struct {
+	Dropped      uint64
+	Coalesced    uint64
+	Disconnected uint64
+}
+
+type stats struct {
+	dropped      uint64
+	coalesced    uint64
+	disconnected uint64
+}
+
+func (s *stats) snapshot() Stats {
+	return Stats{
+		Dropped:      atomic.LoadUint64(&s.dropped),
+		Coalesced:    atomic.LoadUint64(&s.coalesced),
+		Disconnected: atomic.LoadUint64(&s.disconnected),
+	}
+}
+
+// Subscriber is a connection receiving events from the broker. Sending to a
+// subscriber never blocks; events are buffered until read with Next and the
+// broker's policy is applied once the buffer is full.
+type Subscriber struct {
+	mu    sync.Mutex
+	queue []atlasdb.Event
+	err   error
+	ready chan struct{}
+	done  chan struct{}
+	opts  Options
+	stats *stats
+
+	// Set for subscribers of every tribe
+	filter *Filter
+
+	// Live events of the tribes being held, see Hold
+	held map[int64][]atlasdb.Event
+}
+
+func newSubscriber(opts Options, st *stats) *Subscriber {
+	return &Subscriber{
+		queue: make([]atlasdb.Event, 0, opts.BufferSize),
+		ready: make(chan struct{}, 1),
+		done:  make(chan struct{}),
+		opts:  opts,
+		stats: st,
+	}
+}
+
+// Next returns the next event, blocking until one is available, the context
+// is canceled or the subscriber is closed.
+func (s *Subscriber) Next(ctx context.Context) (atlasdb.Event, error) {
+	for {
+		s.mu.Lock()
+		if len(s.queue) > 0 {
+			e := s.queue[0]
+			s.queue[0] = atlasdb.Event{}
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+			return e, nil
+		}
+		err := s.err
+		s.mu.Unlock()
+		if err != nil {
+			return atlasdb.Event{}, err
+		}
+
+		select {
+		case <-s.ready:
+		case <-s.done:
+		case <-ctx.Done():
+			return atlasdb.Event{}, ctx.Err()
+		}
+	}
+}
+
+// send buffers the event without blocking.
+func (s *Subscriber) send(e atlasdb.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.err != nil {
+		return
+	}
+
+	if held, ok := s.held[e.TribeID]; ok {
+		if len(held) >= s.opts.BufferSize {
+			atomic.AddUint64(&s.stats.dropped, 1)
+			held[0] = atlasdb.Event{}
+			held = held[1:]
+		}
+		s.held[e.TribeID] = append(held, e)
+		return
+	}
+
+	if len(s.queue) >= s.opts.BufferSize {
+		switch s.opts.Policy {
+		case PolicyDisconnect:
+			atomic.AddUint64(&s.stats.disconnected, 1)
+			s.closeLocked(ErrSlowConsumer)
+			return
+		case PolicyCoalesce:
+			if s.coalesceLocked(e) {
+				atomic.AddUint64(&s.stats.coalesced, 1)
+				break
+			}
+			fallthrough
+		default:
+			atomic.AddUint64(&s.stats.dropped, 1)
+			s.queue[0] = atlasdb.Event{}
+			s.queue = s.queue[1:]
+		}
+	}
+
+	s.queue = append(s.queue, e)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// preload buffers replayed events regardless of the buffer size.
+func (s *Subscriber) preload(events []atlasdb.Event) {
+	if len(events) == 0 {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.queue = append(s.queue, events...)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// Hold keeps the live events of the tribe from the subscriber until Release,
+// so a snapshot of the tribe is delivered ahead of the events following it.
+// At most BufferSize events are held, dropping the oldest.
+func (s *Subscriber) Hold(tribeID int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.held == nil {
+		s.held = make(map[int64][]atlasdb.Event)
+	}
+	if _, ok := s.held[tribeID]; !ok {
+		s.held[tribeID] = nil
+	}
+}
+
+// Release queues the snapshot, which may be empty, followed by the events held
+// for the tribe since Hold. The snapshot is queued whole regardless of the
+// buffer size.
+func (s *Subscriber) Release(tribeID int64, snapshot []atlasdb.Event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	held := s.held[tribeID]
+	delete(s.held, tribeID)
+	if s.err != nil {
+		return
+	}
+
+	s.queue = append(append(s.queue, snapshot...), held...)
+	select {
+	case s.ready <- struct{}{}:
+	default:
+	}
+}
+
+// coalesceLocked removes a buffered update of the same entity as e, which is
+// superseded by e. e is appended by the caller so events stay in ID order for
+// resuming.
+func (s *Subscriber) coalesceLocked(e atlasdb.Event) bool {
+	update, ok := e.Payload.(atlasdb.TribeEntityUpdate)
+	if !ok {
+		return false
+	}
+	for i := len(s.queue) - 1; i >= 0; i-- {
+		if queued, ok := s.queue[i].Payload.(atlasdb.TribeEntityUpdate); ok && queued.EntityID == update.EntityID {
+			copy(s.queue[i:], s.queue[i+1:])
+			s.queue[len(s.queue)-1] = atlasdb.Event{}
+			s.queue = s.queue[:len(s.queue)-1]
+			return true
+		}
+	}
+	return false
+}
+
+func (s *Subscriber) close(err error) {
+	s.mu.Lock()
+	s.closeLocked(err)
+	s.mu.Unlock()
+}
+
+func (s *Subscriber) closeLocked(err error) {
+	if s.err != nil {
+		return
+	}
+	s.err = err
+	s.queue = nil
+	close(s.done)
+}
@@ -0,0 +1,132 @@
+package eventbroker
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+)
+
+// newTestBroker creates a broker backed by miniredis.
+func newTestBroker(t *testing.T, opts Options) *EventBroker {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	db, err := atlasdb.NewAtlasDB(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	b := NewEventBroker(db, opts)
+	t.Cleanup(b.Close)
+	return b
+}
+
+func entityEvent(entityID uint32, x float32) atlasdb.Event {
+	return atlasdb.Event{
+		Kind:    atlasdb.EventEntityUpdate,
+		Payload: atlasdb.TribeEntityUpdate{EntityID: entityID, X: x},
+	}
+}
+
+// drain returns the queued events of the subscriber.
+func drain(t *testing.T, sub *Subscriber, n int) []atlasdb.Event {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	events := make([]atlasdb.Event, 0, n)
+	for i := 0; i < n; i++ {
+		e, err := sub.Next(ctx)
+		if err != nil {
+			t.Fatalf("Next after %d events: %v", i, err)
+		}
+		events = append(events, e)
+	}
+	return events
+}
+
+func eventSeq(t *testing.T, e atlasdb.Event) uint64 {
+	t.Helper()
+	_, seq, ok := parseEventID(e.ID)
+	if !ok {
+		t.Fatalf("bad event ID %q", e.ID)
+	}
+	return seq
+}
+
+func TestCoalesceResume(t *testing.T) {
+	b := newTestBroker(t, Options{BufferSize: 3, Policy: PolicyCoalesce, ReplaySize: 16, ReplayWindow: time.Minute})
+	sub, _ := b.AddUser("76561197960287930", 100, "")
+
+	b.sendTribeLocal(100, entityEvent(1, 1))
+	b.sendTribeLocal(100, entityEvent(2, 1))
+	b.sendTribeLocal(100, atlasdb.Event{Kind: atlasdb.EventChat, Payload: atlasdb.TribeChat{Message: "ahoy"}})
+	b.sendTribeLocal(100, entityEvent(1, 2))
+
+	events := drain(t, sub, 3)
+	for i := 1; i < len(events); i++ {
+		if eventSeq(t, events[i-1]) >= eventSeq(t, events[i]) {
+			t.Fatalf("events out of order: %s before %s", events[i-1].ID, events[i].ID)
+		}
+	}
+	last := events[2].Payload.(atlasdb.TribeEntityUpdate)
+	if last.EntityID != 1 || last.X != 2 {
+		t.Errorf("coalesced update not at the tail: %+v", last)
+	}
+	if st := b.Stats(); st.Coalesced != 1 {
+		t.Errorf("coalesced = %d, want 1", st.Coalesced)
+	}
+
+	// Resuming after the first delivered event replays the rest in order
+	b.RemoveSubscriber(sub)
+	resumed, ok := b.AddUser("76561197960287930", 100, events[0].ID)
+	if !ok {
+		t.Fatal("subscriber not resumed")
+	}
+	replayed := drain(t, resumed, 2)
+	if replayed[0].ID != events[1].ID || replayed[1].ID != events[2].ID {
+		t.Errorf("replayed %s %s, want %s %s", replayed[0].ID, replayed[1].ID, events[1].ID, events[2].ID)
+	}
+	for _, e := range replayed {
+		if e.TribeID != 100 {
+			t.Errorf("replayed event %s has TribeID %d, want 100", e.ID, e.TribeID)
+		}
+	}
+}
+
+func TestHoldRelease(t *testing.T) {
+	b := newTestBroker(t, Options{BufferSize: 2, Policy: PolicyDropOldest, ReplaySize: 16, ReplayWindow: time.Minute})
+	sub, _ := b.AddUser("76561197960287930", 100, "")
+	b.Subscribe(sub, 200, "")
+
+	sub.Hold(100)
+	b.sendTribeLocal(100, entityEvent(1, 2))
+	b.sendTribeLocal(200, entityEvent(9, 1))
+	b.sendTribeLocal(100, entityEvent(2, 2))
+	b.sendTribeLocal(100, entityEvent(3, 2))
+
+	// Only other tribes are delivered while held
+	if e := drain(t, sub, 1)[0]; e.TribeID != 200 {
+		t.Fatalf("got event of tribe %d while held", e.TribeID)
+	}
+
+	snapshot := []atlasdb.Event{entityEvent(1, 1), entityEvent(2, 1), entityEvent(3, 1)}
+	sub.Release(100, snapshot)
+	events := drain(t, sub, 5)
+	want := []struct {
+		entityID uint32
+		x        float32
+	}{{1, 1}, {2, 1}, {3, 1}, {2, 2}, {3, 2}}
+	for i, w := range want {
+		got := events[i].Payload.(atlasdb.TribeEntityUpdate)
+		if got.EntityID != w.entityID || got.X != w.x {
+			t.Errorf("event %d = entity %d x %v, want entity %d x %v", i, got.EntityID, got.X, w.entityID, w.x)
+		}
+	}
+	if st := b.Stats(); st.Dropped != 1 {
+		t.Errorf("dropped = %d, want the oldest held event", st.Dropped)
+	}
+}
@@ -0,0 +1,24 @@
+package atlasmapserver
+
+import "github.com/antihax/AtlasMap/internal/atlasdb"
+
+// RegisterMessage adds or replaces the decoder for a tribe notification CRC.
+// proto is a pointer to the struct the payload is unpacked into, either with
+// struc tags or by implementing Decode(io.Reader) error. convert turns the
+// unpacked message into the payload of the events of the kind, a nil payload
+// drops the message and a nil convert sends the message as is.
+func (s *AtlasMapServer) RegisterMessage(crc int32, kind string, proto interface{}, convert func(msg interface{}) (interface{}, error)) error {
+	return s.messages.Register(crc, atlasdb.MessageType{
+		Kind:      atlasdb.EventKind(kind),
+		Message:   proto,
+		Transform: convert,
+	})
+}
+
+// DecodeMessage decodes a BubbleWrap framed tribe notification, as published
+// to the tribemsg channels, with the registered messages. A nil event is
+// returned when the message is dropped.
+func (s *AtlasMapServer) DecodeMessage(payload []byte) (*atlasdb.Event, error) {
+	e, _, err := s.messages.Decode(string(payload))
+	return e, err
+}
@@ -0,0 +1,81 @@
+package atlasmapserver_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+
+	"github.com/antihax/AtlasMap/pkg/atlasmapserver"
+	"github.com/lunixbochs/struc"
+)
+
+// sighting is a message type defined outside of the module.
+type sighting struct {
+	EntityID uint32 `struc:"uint32,little"`
+	Count    int32  `struc:"int32,little"`
+}
+
+type sightingPayload struct {
+	EntityID uint32
+	Count    int32
+}
+
+const sightingCRC = 12345
+
+// packSighting frames a sighting with the BubbleWrap header.
+func packSighting(t *testing.T, serverID uint32, msg *sighting) []byte {
+	t.Helper()
+	buf := &bytes.Buffer{}
+	binary.Write(buf, binary.LittleEndian, []int32{1, int32(serverID), sightingCRC})
+	if err := struc.Pack(buf, msg); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestRegisterMessage(t *testing.T) {
+	s := atlasmapserver.NewAtlasMapServer()
+	payload := packSighting(t, 65537, &sighting{EntityID: 99, Count: 3})
+
+	if _, err := s.DecodeMessage(payload); err == nil {
+		t.Fatal("expected an unregistered CRC to fail")
+	}
+
+	err := s.RegisterMessage(sightingCRC, "sighting", &sighting{}, func(msg interface{}) (interface{}, error) {
+		m := msg.(*sighting)
+		if m.Count == 0 {
+			return nil, nil
+		}
+		return sightingPayload{EntityID: m.EntityID, Count: m.Count}, nil
+	})
+	if err != nil {
+		t.Fatalf("RegisterMessage: %v", err)
+	}
+
+	e, err := s.DecodeMessage(payload)
+	if err != nil {
+		t.Fatalf("DecodeMessage: %v", err)
+	}
+	if e.Kind != "sighting" || e.ServerID != 65537 {
+		t.Errorf("unexpected event %+v", e)
+	}
+	if p, ok := e.Payload.(sightingPayload); !ok || p.EntityID != 99 || p.Count != 3 {
+		t.Errorf("unexpected payload %#v", e.Payload)
+	}
+
+	e, err = s.DecodeMessage(packSighting(t, 65537, &sighting{EntityID: 99}))
+	if err != nil || e != nil {
+		t.Errorf("expected the message to be dropped, got %v %v", e, err)
+	}
+}
+
+func TestRegisterMessageInvalid(t *testing.T) {
+	s := atlasmapserver.NewAtlasMapServer()
+
+	if err := s.RegisterMessage(sightingCRC, "", &sighting{}, nil); err == nil {
+		t.Error("expected an error without a kind")
+	}
+	if err := s.RegisterMessage(sightingCRC, "sighting", sighting{}, nil); err == nil {
+		t.Error("expected an error registering a non pointer")
+	}
+}
@@ -0,0 +1,141 @@
+// Package redisstore provides a gorilla sessions store backed by redis so
+// sessions are shared between instances and survive restarts.
+package redisstore
+
+import (
+	"bytes"
+	"context"
+	"encoding/base32"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/securecookie"
+	"github.com/gorilla/sessions"
+)
+
+// ErrInvalidSession is returned when the stored session values cannot be
+// decoded.
+var ErrInvalidSession = errors.New("invalid session data")
+
+// RedisStore stores session values in redis, keyed by a session ID held in a
+// signed cookie. Values expire with the session MaxAge.
+type RedisStore struct {
+	Codecs  []securecookie.Codec
+	Options *sessions.Options
+
+	client    redis.UniversalClient
+	keyPrefix string
+}
+
+// NewRedisStore creates a store using the redis client. keyPairs are used to
+// sign and optionally encrypt the session ID cookie, as with the gorilla
+// stores.
+func NewRedisStore(client redis.UniversalClient, keyPairs ...[]byte) *RedisStore {
+	s := &RedisStore{
+		Codecs: securecookie.CodecsFromPairs(keyPairs...),
+		Options: &sessions.Options{
+			Path:   "/",
+			MaxAge: 86400 * 30,
+		},
+		client:    client,
+		keyPrefix: "session_",
+	}
+	s.MaxAge(s.Options.MaxAge)
+	return s
+}
+
+// MaxAge sets the maximum age of the store and its cookies.
+func (s *RedisStore) MaxAge(age int) {
+	s.Options.MaxAge = age
+	for _, codec := range s.Codecs {
+		if sc, ok := codec.(*securecookie.SecureCookie); ok {
+			sc.MaxAge(age)
+		}
+	}
+}
+
+// Get returns a session for the given name after adding it to the registry.
+func (s *RedisStore) Get(r *http.Request, name string) (*sessions.Session, error) {
+	return sessions.GetRegistry(r).Get(s, name)
+}
+
+// New returns the session stored for the request cookie, or a new session if
+// there is none.
+func (s *RedisStore) New(r *http.Request, name string) (*sessions.Session, error) {
+	session := sessions.NewSession(s, name)
+	opts := *s.Options
+	session.Options = &opts
+	session.IsNew = true
+
+	c, err := r.Cookie(name)
+	if err != nil {
+		return session, nil
+	}
+	if err := securecookie.DecodeMulti(name, c.Value, &session.ID, s.Codecs...); err != nil {
+		return session, err
+	}
+
+	ok, err := s.load(r.Context(), session)
+	if !ok {
+		// Expired sessions are given a new ID when saved
+		session.ID = ""
+	}
+	session.IsNew = !ok
+	return session, err
+}
+
+// Save stores the session in redis and sets the session ID cookie. A MaxAge
+// of zero or less deletes the session.
+func (s *RedisStore) Save(r *http.Request, w http.ResponseWriter, session *sessions.Session) error {
+	if session.Options.MaxAge <= 0 {
+		if session.ID != "" {
+			if err := s.client.Del(r.Context(), s.keyPrefix+session.ID).Err(); err != nil {
+				return err
+			}
+		}
+		http.SetCookie(w, sessions.NewCookie(session.Name(), "", session.Options))
+		return nil
+	}
+
+	if session.ID == "" {
+		session.ID = strings.TrimRight(base32.StdEncoding.EncodeToString(securecookie.GenerateRandomKey(32)), "=")
+	}
+	if err := s.save(r.Context(), session); err != nil {
+		return err
+	}
+
+	encoded, err := securecookie.EncodeMulti(session.Name(), session.ID, s.Codecs...)
+	if err != nil {
+		return err
+	}
+	http.SetCookie(w, sessions.NewCookie(session.Name(), encoded, session.Options))
+	return nil
+}
+
+func (s *RedisStore) save(ctx context.Context, session *sessions.Session) error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(session.Values); err != nil {
+		return err
+	}
+	return s.client.Set(ctx, s.keyPrefix+session.ID, buf.Bytes(), time.Duration(session.Options.MaxAge)*time.Second).Err()
+}
+
+// load reads the session values from redis, returning false if the session
+// does not exist or has expired.
+func (s *RedisStore) load(ctx context.Context, session *sessions.Session) (bool, error) {
+	data, err := s.client.Get(ctx, s.keyPrefix+session.ID).Bytes()
+	if errors.Is(err, redis.Nil) {
+		return false, nil
+	} else if err != nil {
+		return false, err
+	}
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&session.Values); err != nil {
+		return true, fmt.Errorf("%w: %s", ErrInvalidSession, err)
+	}
+	return true, nil
+}
@@ -0,0 +1,132 @@
+package redisstore
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/go-redis/redis/v8"
+	"github.com/gorilla/securecookie"
+)
+
+var testKey = []byte("0123456789abcdef0123456789abcdef")
+
+func newTestStore(t *testing.T) (*RedisStore, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	client := redis.NewClient(&redis.Options{Addr: mr.Addr()})
+	t.Cleanup(func() { client.Close() })
+
+	store := NewRedisStore(client, testKey)
+	store.MaxAge(60)
+	return store, mr
+}
+
+// request returns a request carrying the cookies set on w.
+func request(w *httptest.ResponseRecorder) *http.Request {
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	for _, c := range w.Result().Cookies() {
+		r.AddCookie(c)
+	}
+	return r
+}
+
+// saveSession saves a new session holding steamID.
+func saveSession(t *testing.T, store *RedisStore) *httptest.ResponseRecorder {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["steamID"] = "76561197960287930"
+
+	w := httptest.NewRecorder()
+	if err := store.Save(r, w, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+	return w
+}
+
+func TestSaveAndLoad(t *testing.T) {
+	store, mr := newTestStore(t)
+	w := saveSession(t, store)
+
+	if keys := mr.Keys(); len(keys) != 1 {
+		t.Fatalf("stored keys = %v, want one session", keys)
+	}
+	if ttl := mr.TTL(mr.Keys()[0]); ttl != 60*time.Second {
+		t.Errorf("session TTL = %s, want the MaxAge", ttl)
+	}
+
+	session, err := store.New(request(w), "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if session.IsNew || session.Values["steamID"] != "76561197960287930" {
+		t.Errorf("session not loaded: new %v values %v", session.IsNew, session.Values)
+	}
+}
+
+func TestExpire(t *testing.T) {
+	store, mr := newTestStore(t)
+	w := saveSession(t, store)
+	mr.FastForward(61 * time.Second)
+
+	session, err := store.New(request(w), "session")
+	if err != nil {
+		t.Fatalf("New: %v", err)
+	}
+	if !session.IsNew || session.ID != "" || len(session.Values) != 0 {
+		t.Errorf("expected a new session, got %+v", session)
+	}
+}
+
+func TestDelete(t *testing.T) {
+	store, mr := newTestStore(t)
+	w := saveSession(t, store)
+
+	r := request(w)
+	session, err := store.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Options.MaxAge = -1
+	deleted := httptest.NewRecorder()
+	if err := store.Save(r, deleted, session); err != nil {
+		t.Fatalf("Save: %v", err)
+	}
+
+	if keys := mr.Keys(); len(keys) != 0 {
+		t.Errorf("session still stored: %v", keys)
+	}
+	if c := deleted.Result().Cookies(); len(c) != 1 || c[0].MaxAge >= 0 {
+		t.Errorf("cookie not cleared: %v", c)
+	}
+}
+
+func TestInvalidSession(t *testing.T) {
+	store, mr := newTestStore(t)
+
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	r.AddCookie(&http.Cookie{Name: "session", Value: "forged"})
+	_, err := store.New(r, "session")
+	var cookieErr securecookie.Error
+	if !errors.As(err, &cookieErr) || !cookieErr.IsDecode() {
+		t.Errorf("expected a cookie decode error, got %v", err)
+	}
+
+	w := saveSession(t, store)
+	mr.Set(mr.Keys()[0], "not gob")
+	if _, err := store.New(request(w), "session"); !errors.Is(err, ErrInvalidSession) {
+		t.Errorf("expected ErrInvalidSession, got %v", err)
+	}
+
+	mr.Close()
+	if _, err := store.New(request(w), "session"); err == nil || errors.Is(err, ErrInvalidSession) {
+		t.Errorf("expected a redis error, got %v", err)
+	}
+}
@@ -0,0 +1,180 @@
+package atlasmapserver
+
+import (
+	"context"
+	"net/http"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+	"github.com/rs/zerolog/log"
+)
+
+// Role is the access level of a player. Each role includes the access of the
+// roles below it.
+type Role int
+
+const (
+	RoleNone Role = iota
+	RoleTribeMember
+	RoleTribeAdmin
+	RoleTribeOwner
+	RoleServerAdmin
+)
+
+func (r Role) String() string {
+	switch r {
+	case RoleTribeMember:
+		return "member"
+	case RoleTribeAdmin:
+		return "tribeadmin"
+	case RoleTribeOwner:
+		return "owner"
+	case RoleServerAdmin:
+		return "serveradmin"
+	}
+	return "none"
+}
+
+// MarshalText encodes the role by name.
+func (r Role) MarshalText() ([]byte, error) {
+	return []byte(r.String()), nil
+}
+
+// Principal is the authenticated player and their tribe membership.
+type Principal struct {
+	SteamID     string
+	PlayerID    int64
+	TribeID     int64
+	RankGroupID int
+	Role        Role
+
+	// Permissions granted by the tribe's rank groups and administration
+	Permissions []string
+}
+
+// HasRole determines if the principal has at least the role.
+func (p *Principal) HasRole(role Role) bool {
+	return p.Role >= role
+}
+
+// HasPermission determines if the principal holds the tribe permission. Tribe
+// owners and server administrators hold every permission.
+func (p *Principal) HasPermission(permission string) bool {
+	if p.HasRole(RoleTribeOwner) {
+		return true
+	}
+	for _, held := range p.Permissions {
+		if held == permission {
+			return true
+		}
+	}
+	return false
+}
+
+// tribeRole returns the role of a member within their tribe.
+func tribeRole(tribe *atlasdb.TribeData, playerID int64, steamID string) Role {
+	if tribe.IsOwner(playerID) {
+		return RoleTribeOwner
+	} else if tribe.IsAdmin(playerID, steamID) {
+		return RoleTribeAdmin
+	}
+	return RoleTribeMember
+}
+
+// getPrincipal returns the principal for the request, loading it from redis if
+// a previous middleware has not already done so.
+func (s *AtlasMapServer) getPrincipal(r *http.Request) (*Principal, error) {
+	if p, ok := r.Context().Value(PrincipalKey).(*Principal); ok {
+		return p, nil
+	}
+
+	session := r.Context().Value(SessionKey).(*sessions.Session)
+	p := &Principal{
+		SteamID:  session.Values["steamID"].(string),
+		PlayerID: session.Values["playerID"].(int64),
+	}
+
+	player, err := s.db.GetPlayerInfoFromPlayerID(r.Context(), p.PlayerID)
+	if err != nil {
+		return nil, err
+	}
+	p.TribeID = player.TribeID
+	p.RankGroupID = player.RankGroupID
+	s.tribes.set(p.PlayerID, p.TribeID)
+
+	if p.TribeID > 0 {
+		tribe, err := s.db.GetTribeByID(r.Context(), p.TribeID)
+		if err != nil {
+			return nil, err
+		}
+		p.Role = tribeRole(tribe, p.PlayerID, p.SteamID)
+
+		// Bad rank data only costs the member their rank group permissions
+		groups, err := tribe.RankGroups()
+		if err != nil {
+			log.Error().Err(err).Int64("tribeID", p.TribeID).Msg("tribe.RankGroups")
+		}
+		p.Permissions = tribe.MemberPermissions(player, p.SteamID, groups)
+	}
+
+	// Checked on every request so removing an administrator takes effect
+	// without waiting for their session to expire
+	if s.isAdmin(p.SteamID) {
+		p.Role = RoleServerAdmin
+	}
+
+	return p, nil
+}
+
+// isAdmin determines if the steamID is a configured server administrator.
+func (s *AtlasMapServer) isAdmin(steamID string) bool {
+	for _, id := range s.config.AdminSteamIDs {
+		if id != "" && id == steamID {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize loads the principal into the request context and passes the
+// request on if allowed approves it.
+func (s *AtlasMapServer) authorize(allowed func(p *Principal) bool) mux.MiddlewareFunc {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			p, err := s.getPrincipal(r)
+			if err != nil {
+				dbError(w, err, "getPrincipal")
+				return
+			}
+
+			if !allowed(p) {
+				http.Error(w, "Forbidden", http.StatusForbidden)
+				return
+			}
+
+			r = r.WithContext(context.WithValue(r.Context(), PrincipalKey, p))
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// requireRole restricts the routes to players with at least the role.
+func (s *AtlasMapServer) requireRole(role Role) mux.MiddlewareFunc {
+	return s.authorize(func(p *Principal) bool {
+		return p.HasRole(role)
+	})
+}
+
+// requirePermission restricts the routes to players holding any of the tribe
+// permissions.
+func (s *AtlasMapServer) requirePermission(permissions ...string) mux.MiddlewareFunc {
+	return s.authorize(func(p *Principal) bool {
+		for _, permission := range permissions {
+			if p.HasPermission(permission) {
+				return true
+			}
+		}
+		return false
+	})
+}
@@ -0,0 +1,143 @@
+package atlasmapserver
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/alicebob/miniredis/v2"
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/gorilla/mux"
+	"github.com/gorilla/sessions"
+)
+
+// newTestServer creates a server backed by miniredis and a cookie session
+// store.
+func newTestServer(t *testing.T) (*AtlasMapServer, *miniredis.Miniredis) {
+	t.Helper()
+	mr := miniredis.RunT(t)
+	db, err := atlasdb.NewAtlasDB(mr.Addr(), "", 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+
+	s := NewAtlasMapServer()
+	s.config = &Configuration{}
+	s.store = sessions.NewCookieStore([]byte("0123456789abcdef0123456789abcdef"))
+	s.db = db
+	return s, mr
+}
+
+// sessionCookie returns the session cookie of a logged in player, with extra
+// session values.
+func sessionCookie(t *testing.T, s *AtlasMapServer, steamID string, playerID int64, values map[string]interface{}) *http.Cookie {
+	t.Helper()
+	r := httptest.NewRequest(http.MethodGet, "/", nil)
+	w := httptest.NewRecorder()
+	session, err := s.store.New(r, "session")
+	if err != nil {
+		t.Fatal(err)
+	}
+	session.Values["steamID"] = steamID
+	session.Values["playerID"] = playerID
+	for k, v := range values {
+		session.Values[k] = v
+	}
+	if err := session.Save(r, w); err != nil {
+		t.Fatal(err)
+	}
+	return w.Result().Cookies()[0]
+}
+
+func TestRequireRole(t *testing.T) {
+	s, mr := newTestServer(t)
+	s.config.AdminSteamIDs = []string{"76561197960287930"}
+
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100", "PlayerName", "Jack")
+	mr.HSet("playerinfo:2", "PlayerId", "2", "TribeID", "100", "PlayerName", "Gibbs")
+	mr.HSet("playerinfo:3", "PlayerId", "3", "PlayerName", "Norrington")
+	mr.HSet("tribedata:100", "TribeID", "100", "TribeName", "Pirates", "TribeOwnerPlayerDataID", "1")
+
+	router := mux.NewRouter()
+	router.Use(s.sessionMiddleware)
+	ok := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write([]byte(r.Context().Value(PrincipalKey).(*Principal).Role.String()))
+	})
+	router.Handle("/owner", s.requireRole(RoleTribeOwner)(ok))
+	router.Handle("/admin", s.requireRole(RoleServerAdmin)(ok))
+
+	tests := []struct {
+		name   string
+		path   string
+		cookie *http.Cookie
+		status int
+		role   string
+	}{
+		{"no session", "/owner", nil, http.StatusUnauthorized, ""},
+		{"tribe owner", "/owner", sessionCookie(t, s, "76561197960287931", 1, nil), http.StatusOK, "owner"},
+		{"tribe member", "/owner", sessionCookie(t, s, "76561197960287932", 2, nil), http.StatusForbidden, ""},
+		{"owner is not admin", "/admin", sessionCookie(t, s, "76561197960287931", 1, nil), http.StatusForbidden, ""},
+		{"server admin", "/admin", sessionCookie(t, s, "76561197960287930", 3, nil), http.StatusOK, "serveradmin"},
+		{"server admin above owner", "/owner", sessionCookie(t, s, "76561197960287930", 3, nil), http.StatusOK, "serveradmin"},
+		{"revoked admin", "/admin", sessionCookie(t, s, "76561197960287933", 3, map[string]interface{}{"admin": true}), http.StatusForbidden, ""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, test.path, nil)
+			if test.cookie != nil {
+				r.AddCookie(test.cookie)
+			}
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Fatalf("status = %d, want %d", w.Code, test.status)
+			}
+			if test.role != "" && w.Body.String() != test.role {
+				t.Errorf("role = %q, want %q", w.Body.String(), test.role)
+			}
+		})
+	}
+}
+
+func TestRequirePermission(t *testing.T) {
+	s, mr := newTestServer(t)
+	s.config.AdminSteamIDs = []string{"76561197960287930"}
+
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100", "PlayerName", "Jack")
+	mr.HSet("playerinfo:2", "PlayerId", "2", "TribeID", "100", "PlayerName", "Gibbs", "RankGroupId", "0")
+	mr.HSet("playerinfo:3", "PlayerId", "3", "TribeID", "100", "PlayerName", "Cotton", "RankGroupId", "1")
+	mr.HSet("playerinfo:4", "PlayerId", "4", "PlayerName", "Norrington")
+	mr.HSet("tribedata:100", "TribeID", "100", "TribeName", "Pirates", "TribeOwnerPlayerDataID", "1",
+		"TribeRankGroups", `((RankGroupName="Officer",bAllowPromotions=True),(RankGroupName="Crew"))`)
+
+	router := mux.NewRouter()
+	router.Use(s.sessionMiddleware)
+	router.Handle("/promote", s.requirePermission(atlasdb.PermissionPromote)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {})))
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+		status int
+	}{
+		{"tribe owner", sessionCookie(t, s, "76561197960287931", 1, nil), http.StatusOK},
+		{"rank group with the permission", sessionCookie(t, s, "76561197960287932", 2, nil), http.StatusOK},
+		{"rank group without the permission", sessionCookie(t, s, "76561197960287933", 3, nil), http.StatusForbidden},
+		{"server admin", sessionCookie(t, s, "76561197960287930", 4, nil), http.StatusOK},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/promote", nil)
+			r.AddCookie(test.cookie)
+			w := httptest.NewRecorder()
+			router.ServeHTTP(w, r)
+
+			if w.Code != test.status {
+				t.Errorf("status = %d, want %d", w.Code, test.status)
+			}
+		})
+	}
+}
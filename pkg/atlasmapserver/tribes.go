@@ -0,0 +1,159 @@
+package atlasmapserver
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/antihax/AtlasMap/internal/atlasdb"
+	"github.com/rs/zerolog/log"
+)
+
+// memberCacheTTL is how long a tribe's member list is reused before it is
+// loaded from redis again.
+const memberCacheTTL = 15 * time.Second
+
+// tribeIndexRefresh is how often the tribes of every known player are read
+// again. Scans in between only index players not seen before.
+const tribeIndexRefresh = 10 * time.Minute
+
+// tribeIndex maps tribes to their members. ATLAS does not index tribe members
+// so the index is kept from the playerinfo of the players found by fetch.
+type tribeIndex struct {
+	mu      sync.RWMutex
+	players map[int64]int64
+	tribes  map[int64]map[int64]struct{}
+}
+
+func newTribeIndex() *tribeIndex {
+	return &tribeIndex{
+		players: make(map[int64]int64),
+		tribes:  make(map[int64]map[int64]struct{}),
+	}
+}
+
+// set moves the player to the tribe, 0 for no tribe.
+func (t *tribeIndex) set(playerID, tribeID int64) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if old, ok := t.players[playerID]; ok {
+		if old == tribeID {
+			return
+		}
+		delete(t.tribes[old], playerID)
+		if len(t.tribes[old]) == 0 {
+			delete(t.tribes, old)
+		}
+	}
+
+	t.players[playerID] = tribeID
+	if tribeID == 0 {
+		return
+	}
+	if t.tribes[tribeID] == nil {
+		t.tribes[tribeID] = make(map[int64]struct{})
+	}
+	t.tribes[tribeID][playerID] = struct{}{}
+}
+
+// members returns the playerIDs last seen in the tribe.
+func (t *tribeIndex) members(tribeID int64) []int64 {
+	t.mu.RLock()
+	defer t.mu.RUnlock()
+	ids := make([]int64, 0, len(t.tribes[tribeID]))
+	for id := range t.tribes[tribeID] {
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+// memberCacheEntry holds a tribe's members. The lock is held while loading
+// so concurrent requests for the tribe wait for a single load.
+type memberCacheEntry struct {
+	mu      sync.Mutex
+	loaded  time.Time
+	members []*atlasdb.PlayerInfo
+}
+
+// memberCache caches the member lists of tribes for memberCacheTTL.
+type memberCache struct {
+	mu      sync.Mutex
+	entries map[int64]*memberCacheEntry
+}
+
+func newMemberCache() *memberCache {
+	return &memberCache{entries: make(map[int64]*memberCacheEntry)}
+}
+
+// entry returns the cache entry of the tribe, dropping expired entries of
+// other tribes.
+func (c *memberCache) entry(tribeID int64) *memberCacheEntry {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[tribeID]
+	if ok {
+		return e
+	}
+
+	for id, old := range c.entries {
+		if old.mu.TryLock() {
+			if time.Since(old.loaded) > memberCacheTTL {
+				delete(c.entries, id)
+			}
+			old.mu.Unlock()
+		}
+	}
+	e = &memberCacheEntry{}
+	c.entries[tribeID] = e
+	return e
+}
+
+// indexPlayers refreshes the tribes of the players in the tribe index.
+func (s *AtlasMapServer) indexPlayers(ctx context.Context, playerIDs []int64) {
+	if len(playerIDs) == 0 {
+		return
+	}
+	tribes, err := s.db.GetPlayerTribeIDs(ctx, playerIDs)
+	if err != nil {
+		log.Error().Err(err).Msg("db.GetPlayerTribeIDs")
+		return
+	}
+	for playerID, tribeID := range tribes {
+		s.tribes.set(playerID, tribeID)
+	}
+}
+
+// tribeMembers returns the PlayerInfo of the tribe's members. Only the players
+// indexed to the tribe are loaded, and at most once per memberCacheTTL.
+func (s *AtlasMapServer) tribeMembers(ctx context.Context, tribeID int64) ([]*atlasdb.PlayerInfo, error) {
+	e := s.members.entry(tribeID)
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.members != nil && time.Since(e.loaded) < memberCacheTTL {
+		return e.members, nil
+	}
+
+	candidates := s.tribes.members(tribeID)
+	members, err := s.db.GetTribeMembers(ctx, tribeID, candidates)
+	if err != nil {
+		return nil, err
+	}
+
+	// Players that left are moved to their new tribe by the next scan
+	found := make(map[int64]bool, len(members))
+	for _, member := range members {
+		found[member.PlayerID] = true
+	}
+	for _, id := range candidates {
+		if !found[id] {
+			s.tribes.set(id, 0)
+		}
+	}
+
+	e.members = members
+	e.loaded = time.Now()
+	return members, nil
+}
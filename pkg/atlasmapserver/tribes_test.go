@@ -0,0 +1,97 @@
+package atlasmapserver
+
+import (
+	"context"
+	"sort"
+	"testing"
+	"time"
+)
+
+func TestTribeIndex(t *testing.T) {
+	idx := newTribeIndex()
+	idx.set(1, 100)
+	idx.set(2, 100)
+	idx.set(3, 200)
+	idx.set(2, 200)
+	idx.set(4, 0)
+
+	got := idx.members(200)
+	sort.Slice(got, func(i, j int) bool { return got[i] < got[j] })
+	if len(got) != 2 || got[0] != 2 || got[1] != 3 {
+		t.Errorf("tribe 200 members = %v, want [2 3]", got)
+	}
+	if got := idx.members(100); len(got) != 1 || got[0] != 1 {
+		t.Errorf("tribe 100 members = %v, want [1]", got)
+	}
+	if got := idx.members(0); len(got) != 0 {
+		t.Errorf("players without a tribe are indexed: %v", got)
+	}
+}
+
+func TestTribeMembers(t *testing.T) {
+	s, mr := newTestServer(t)
+	ctx := context.Background()
+
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100", "PlayerName", "Jack")
+	mr.HSet("playerinfo:2", "PlayerId", "2", "TribeID", "100", "PlayerName", "Gibbs")
+	mr.HSet("playerinfo:3", "PlayerId", "3", "TribeID", "200", "PlayerName", "Norrington")
+	s.indexPlayers(ctx, []int64{1, 2, 3, 4})
+
+	members, err := s.tribeMembers(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Fatalf("got %d members, want 2", len(members))
+	}
+
+	// Cached until memberCacheTTL passes
+	mr.HSet("playerinfo:2", "TribeID", "200")
+	members, err = s.tribeMembers(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 2 {
+		t.Errorf("got %d cached members, want 2", len(members))
+	}
+
+	// A reload drops the player that left from the index
+	s.members.entry(100).loaded = time.Time{}
+	members, err = s.tribeMembers(ctx, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(members) != 1 || members[0].PlayerName != "Jack" {
+		t.Errorf("unexpected members after reload %+v", members)
+	}
+	if got := s.tribes.members(100); len(got) != 1 {
+		t.Errorf("index still holds %v", got)
+	}
+}
+
+func TestScanPlayersIndexesNewPlayers(t *testing.T) {
+	s, mr := newTestServer(t)
+	ctx := context.Background()
+
+	mr.Set("PlayerDataId:1", "76561197960287931")
+	mr.HSet("playerinfo:1", "PlayerId", "1", "TribeID", "100")
+	scanner := s.db.NewPlayerScanner(100)
+	s.scanPlayers(ctx, scanner, true)
+	if got := s.tribes.members(100); len(got) != 1 {
+		t.Fatalf("new player not indexed: %v", got)
+	}
+
+	// Known players are not read again by scans
+	mr.HSet("playerinfo:1", "TribeID", "200")
+	mr.Set("PlayerDataId:2", "76561197960287932")
+	mr.HSet("playerinfo:2", "PlayerId", "2", "TribeID", "200")
+	s.scanPlayers(ctx, scanner, true)
+	if got := s.tribes.members(200); len(got) != 1 || got[0] != 2 {
+		t.Errorf("tribe 200 members = %v, want only the new player", got)
+	}
+
+	s.indexPlayers(ctx, s.knownPlayerIDs())
+	if got := s.tribes.members(200); len(got) != 2 {
+		t.Errorf("refresh did not move the known player: %v", got)
+	}
+}